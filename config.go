@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// envPrefix is prepended to the environment variables setting flags.
+const envPrefix = "SOCKET_ACTIVATE_"
+
+// flagAliases are the descriptive names of the short flags, for use in config
+// files and environment variables.
+var flagAliases = map[string]string{
+	"mode":        "m",
+	"unit":        "u",
+	"destination": "a",
+	"dest":        "a",
+	"timeout":     "t",
+}
+
+// flagSynonyms are flags setting the same variable as another one, by the
+// name of that other flag.
+var flagSynonyms = map[string]string{
+	"no-dbus": "no-unit",
+}
+
+// flagName resolves an alias to the name of its flag.
+func flagName(name string) string {
+	if alias, ok := flagAliases[name]; ok {
+		return alias
+	}
+	return name
+}
+
+// envName returns the environment variable for a flag or alias, e.g.
+// SOCKET_ACTIVATE_BACKEND_TIMEOUT for backend-timeout.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// setFlags returns the names of the flags set so far, a synonym counting for
+// the flag it stands for as well.
+func setFlags() map[string]bool {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+		if name, ok := flagSynonyms[f.Name]; ok {
+			given[name] = true
+		}
+	})
+	return given
+}
+
+// setFlagsFromEnv sets the flags not given on the command line from their
+// environment variables, named after the flag or one of its aliases.
+func setFlagsFromEnv() error {
+	given := setFlags()
+
+	names := make(map[string][]string)
+	flag.VisitAll(func(f *flag.Flag) { names[f.Name] = []string{f.Name} })
+	for alias, name := range flagAliases {
+		names[name] = append(names[name], alias)
+	}
+
+	for name, candidates := range names {
+		if given[name] {
+			continue
+		}
+		for _, candidate := range candidates {
+			value, ok := os.LookupEnv(envName(candidate))
+			if !ok {
+				continue
+			}
+			if err := flag.Set(name, value); err != nil {
+				return fmt.Errorf("%s: %w", envName(candidate), err)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// setFlagsFromFile sets the flags not given otherwise from a TOML config
+// file. Keys are flag names or their aliases, values strings, numbers or
+// booleans, durations are given as strings like "15m".
+func setFlagsFromFile(path string, given map[string]bool) error {
+	var options map[string]any
+	meta, err := toml.DecodeFile(path, &options)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	for _, key := range meta.Keys() {
+		if len(key) > 1 {
+			continue // inside a table, rejected with it
+		}
+		name := flagName(key[0])
+		if name == "config" || flag.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown option %q", path, key[0])
+		}
+		value, err := configValue(options[key[0]])
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", path, key[0], err)
+		}
+		if given[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, key[0], err)
+		}
+	}
+	return nil
+}
+
+// reloadFlagsFromFile sets the flags not given otherwise from a config file
+// again, resetting those it no longer mentions to their defaults. Synonyms
+// are skipped, resetting them would reset the flag they stand for again.
+func reloadFlagsFromFile(path string, given map[string]bool) error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		_, synonym := flagSynonyms[f.Name]
+		if !given[f.Name] && !synonym && err == nil {
+			err = f.Value.Set(f.DefValue)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return setFlagsFromFile(path, given)
+}
+
+// configValue formats a value of the config file as flag value.
+func configValue(value any) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case int64:
+		return strconv.FormatInt(value, 10), nil
+	case float64:
+		return strconv.FormatFloat(value, 'g', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	}
+	return "", errors.New("must be a string, number or boolean")
+}
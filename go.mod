@@ -1,5 +1,10 @@
 module github.com/andrioid/socket-activate
 
-go 1.14
+go 1.21
 
-require github.com/godbus/dbus v4.1.0+incompatible
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/expr-lang/expr v1.17.8
+	github.com/godbus/dbus v4.1.0+incompatible
+	golang.org/x/net v0.35.0
+)
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// journalSocket receives log entries in the journal's native protocol.
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalHandler is a slog.Handler sending records to the systemd journal, with
+// the attributes as journal fields and appended to the message like the text handler does.
+type journalHandler struct {
+	conn       *net.UnixConn
+	level      slog.Leveler
+	identifier string      // SYSLOG_IDENTIFIER of the entries
+	attrs      []slog.Attr // added by WithAttrs, keys already prefixed by their groups
+	group      string      // prefix of attribute keys, e.g. "tls."
+}
+
+func newJournalHandler(level slog.Leveler) (*journalHandler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journalHandler{conn: conn, level: level, identifier: filepath.Base(os.Args[0])}, nil
+}
+
+func (h *journalHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append([]slog.Attr{}, h.attrs...)
+	for _, attr := range attrs {
+		h2.attrs = append(h2.attrs, slog.Attr{Key: h.group + attr.Key, Value: attr.Value})
+	}
+	return &h2
+}
+
+func (h *journalHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.group = h.group + name + "."
+	return &h2
+}
+
+func (h *journalHandler) Handle(_ context.Context, r slog.Record) error {
+	var fields bytes.Buffer
+	message := []byte(r.Message)
+
+	var add func(key string, v slog.Value)
+	add = func(key string, v slog.Value) {
+		v = v.Resolve()
+		if v.Kind() == slog.KindGroup {
+			for _, attr := range v.Group() {
+				add(key+"."+attr.Key, attr.Value)
+			}
+			return
+		}
+		s := v.String()
+		message = append(message, ' ')
+		message = append(message, key...)
+		message = append(message, '=')
+		if s == "" || strings.ContainsAny(s, " =\"\n") {
+			message = strconv.AppendQuote(message, s)
+		} else {
+			message = append(message, s...)
+		}
+		writeJournalField(&fields, journalFieldName(key), s)
+	}
+	for _, attr := range h.attrs {
+		add(attr.Key, attr.Value)
+	}
+	r.Attrs(func(attr slog.Attr) bool {
+		add(h.group+attr.Key, attr.Value)
+		return true
+	})
+
+	writeJournalField(&fields, "MESSAGE", string(message))
+	writeJournalField(&fields, "PRIORITY", strconv.Itoa(journalPriority(r.Level)))
+	writeJournalField(&fields, "SYSLOG_IDENTIFIER", h.identifier)
+	_, err := h.conn.Write(fields.Bytes())
+	return err
+}
+
+// journalPriority maps a log level to a syslog priority.
+func journalPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3 // err
+	case level >= slog.LevelWarn:
+		return 4 // warning
+	case level >= slog.LevelInfo:
+		return 6 // info
+	}
+	return 7 // debug
+}
+
+// journalFieldName turns an attribute key into a valid journal field name,
+// which only consists of uppercase letters, digits and underscores.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+	// fields starting with an underscore are trusted ones set by the journal itself
+	name = strings.TrimLeft(name, "_")
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		name = "F_" + name
+	}
+	return name
+}
+
+// writeJournalField appends a field in the native protocol, values containing
+// newlines are length-prefixed.
+func writeJournalField(buf *bytes.Buffer, name string, value string) {
+	buf.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
@@ -0,0 +1,33 @@
+//go:build linux && !386
+
+package proxy
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// acceptQueueLength returns the number of connections waiting in the accept
+// queue of a listening TCP socket, which TCP_INFO reports as unacked.
+func acceptQueueLength(l net.Listener) (int, bool) {
+	tcpListener, ok := l.(*net.TCPListener)
+	if !ok {
+		return 0, false
+	}
+	raw, err := tcpListener.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+
+	var info syscall.TCPInfo
+	var errno syscall.Errno
+	err = raw.Control(func(fd uintptr) {
+		size := uint32(unsafe.Sizeof(info))
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO, uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err != nil || errno != 0 {
+		return 0, false
+	}
+	return int(info.Unacked), true
+}
@@ -0,0 +1,10 @@
+//go:build !linux || 386
+
+package proxy
+
+import "net"
+
+// acceptQueueLength is only supported on Linux.
+func acceptQueueLength(l net.Listener) (int, bool) {
+	return 0, false
+}
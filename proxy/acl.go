@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// parsePrefixes parses a comma-separated list of CIDRs, single addresses are
+// taken as prefixes of full length.
+func parsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// clientAllowed checks the address of a client against the deny and allow
+// lists. Denying takes precedence, an empty allow list allows everyone not
+// denied. Clients without IP address, e.g. on Unix sockets, are always allowed.
+func (p *Proxy) clientAllowed(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+	if !ok {
+		return true
+	}
+	ip = ip.Unmap()
+
+	s := p.current.Load()
+	for _, prefix := range s.denyPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	if len(s.allowPrefixes) == 0 {
+		return true
+	}
+	for _, prefix := range s.allowPrefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
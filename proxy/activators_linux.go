@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// activatorLock registers a proxy as activator of its units by holding a lock
+// on its own file in a directory per unit shared by all activators of that
+// unit. Locks of crashed proxies are released by the kernel, so their files
+// are just skipped.
+type activatorLock struct {
+	units []unitLock
+}
+
+type unitLock struct {
+	unit string
+	dir  string
+	file *os.File // nil once unregistered
+	name string   // of file, <pid>-<random>.lock
+}
+
+// lockTempPrefix starts the names of lock files that aren't locked yet, which
+// must not be taken for stale ones.
+const lockTempPrefix = ".tmp-"
+
+func registerActivator(lockDir string, units []string) (*activatorLock, error) {
+	a := &activatorLock{}
+	for _, unit := range units {
+		lock, err := lockUnit(filepath.Join(lockDir, unit))
+		if err != nil {
+			a.unregister()
+			return nil, err
+		}
+		lock.unit = unit
+		a.units = append(a.units, lock)
+	}
+	return a, nil
+}
+
+// lockUnit creates and locks the file of this proxy in dir. It only gets its
+// name once it is locked, so a proxy releasing meanwhile doesn't remove it.
+func lockUnit(dir string) (unitLock, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return unitLock{}, err
+	}
+	f, err := os.CreateTemp(dir, lockTempPrefix+"*")
+	if err != nil {
+		return unitLock{}, err
+	}
+	// blocking, as a proxy releasing may try the lock meanwhile
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		os.Remove(f.Name())
+		f.Close()
+		return unitLock{}, fmt.Errorf("locking %s: %w", f.Name(), err)
+	}
+	// unique even for several proxies in one process
+	name := filepath.Join(dir, strconv.Itoa(os.Getpid())+"-"+strings.TrimPrefix(filepath.Base(f.Name()), lockTempPrefix)+".lock")
+	if err := os.Rename(f.Name(), name); err != nil {
+		os.Remove(f.Name())
+		f.Close()
+		return unitLock{}, err
+	}
+	return unitLock{dir: dir, file: f, name: name}, nil
+}
+
+// unregister removes the files of the proxy, so it no longer counts as
+// activator. It is safe to be called more than once.
+func (a *activatorLock) unregister() {
+	for i := range a.units {
+		if f := a.units[i].file; f != nil {
+			os.Remove(a.units[i].name)
+			f.Close()
+			a.units[i].file = nil
+		}
+	}
+}
+
+// release unregisters the proxy and returns the units other proxies still are
+// activators of.
+func (a *activatorLock) release() ([]string, error) {
+	a.unregister()
+
+	var inUse []string
+	var errs []error
+	for _, lock := range a.units {
+		used, err := otherActivators(lock.dir)
+		if err != nil {
+			errs = append(errs, err)
+		} else if used {
+			inUse = append(inUse, lock.unit)
+		}
+	}
+	return inUse, errors.Join(errs...)
+}
+
+// otherActivators reports whether a proxy holds a lock in dir, removing the
+// files of those that are gone.
+func otherActivators(dir string) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		f, err := os.Open(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		// a lock we can get is left over by a proxy that is gone, unless the
+		// file isn't locked yet by a proxy just registering
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil && !strings.HasPrefix(entry.Name(), lockTempPrefix) {
+			os.Remove(f.Name())
+		}
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestActivatorLockPerUnit(t *testing.T) {
+	dir := t.TempDir()
+	both, err := registerActivator(dir, []string{"app.service", "sidecar.service"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err := registerActivator(dir, []string{"app.service"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a file left over by a proxy that is gone doesn't count
+	if err := os.WriteFile(filepath.Join(dir, "sidecar.service", "1-stale.lock"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	inUse, err := both.release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"app.service"}; !reflect.DeepEqual(inUse, want) {
+		t.Errorf("release() = %v, want %v still in use", inUse, want)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, "sidecar.service")); len(entries) != 0 {
+		t.Errorf("files %v left for sidecar.service, want none", entries)
+	}
+
+	// released again by Start on its way out
+	both.unregister()
+	if inUse, err := app.release(); len(inUse) != 0 || err != nil {
+		t.Errorf("release() of the last activator = %v, %v, want none in use", inUse, err)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package proxy
+
+import "errors"
+
+type activatorLock struct{}
+
+// registerActivator is only supported on Linux.
+func registerActivator(lockDir string, units []string) (*activatorLock, error) {
+	return nil, errors.New("activator lock files are only supported on Linux")
+}
+
+func (a *activatorLock) unregister() {}
+
+func (a *activatorLock) release() ([]string, error) {
+	return nil, nil
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditLog appends a JSON line per start and stop of the units to a file, e.g.
+// for billing. Lines are synced right away, so they survive a crash.
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// auditEvent is a line of the audit log.
+type auditEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"` // start or stop
+	Units    []string  `json:"units"`
+	Trigger  string    `json:"trigger,omitempty"` // client whose connection started the units, startup or restart-on-failure
+	Reason   string    `json:"reason,omitempty"`  // why the units were stopped
+	Duration float64   `json:"duration_seconds"`  // of starting or stopping the units
+	Uptime   float64   `json:"uptime_seconds,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: f}, nil
+}
+
+// record appends event, a nil auditLog records nothing.
+func (a *auditLog) record(event auditEvent) error {
+	if a == nil {
+		return nil
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+// audit records event in the audit log, if any, logging failures to do so.
+func (p *Proxy) audit(event auditEvent) {
+	event.Time = time.Now()
+	if err := p.auditLog.record(event); err != nil {
+		p.log.Warn("writing audit log failed", "path", p.config.AuditLog, "err", err)
+	}
+}
@@ -0,0 +1,338 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// restartAfterDialFailures is how many connections in a row must fail to reach
+// the backend before the unit is restarted with restart on failure.
+const restartAfterDialFailures = 3
+
+// backendNetwork returns the network and address to dial for a destination.
+// Destinations prefixed with "unix:" or given as absolute path are Unix
+// sockets, everything else is dialed via TCP.
+func backendNetwork(destination string) (string, string) {
+	if strings.HasPrefix(destination, "unix:") {
+		return "unix", strings.TrimPrefix(destination, "unix:")
+	}
+	if strings.HasPrefix(destination, "/") {
+		return "unix", destination
+	}
+	return "tcp", destination
+}
+
+// parseBackends splits a comma-separated list of backend addresses.
+func parseBackends(destination string) ([]string, error) {
+	var backends []string
+	for _, backend := range strings.Split(destination, ",") {
+		backend = strings.TrimSpace(backend)
+		if backend == "" {
+			continue
+		}
+		if err := validateBackend(backend); err != nil {
+			return nil, err
+		}
+		backends = append(backends, backend)
+	}
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("no backend address given")
+	}
+	return backends, nil
+}
+
+// backendVars are the values of a connection that can be used in backend
+// addresses: %P is the local port of the activated socket, %H the server name
+// or host the connection was routed by.
+type backendVars struct {
+	port string
+	host string
+}
+
+// connectionVars returns the backendVars of a connection routed by host.
+func connectionVars(localAddr net.Addr, host string) backendVars {
+	var vars backendVars
+	if _, port, err := net.SplitHostPort(localAddr.String()); err == nil {
+		vars.port = port
+	}
+	vars.host = host
+	return vars
+}
+
+// expand substitutes the connection's values in a backend address.
+func (v backendVars) expand(backend string) string {
+	return strings.NewReplacer("%P", v.port, "%H", v.host).Replace(backend)
+}
+
+// isTemplate reports whether a backend address depends on the connection.
+func isTemplate(backend string) bool {
+	return strings.Contains(backend, "%P") || strings.Contains(backend, "%H")
+}
+
+// validateBackend checks a backend address up front, so a malformed one fails
+// at startup rather than on the first connection. IPv6 addresses need
+// brackets and may have a zone, e.g. [fe80::1%eth0]:80.
+func validateBackend(backend string) error {
+	network, address := backendNetwork(backend)
+	if network == "unix" {
+		if address == "" {
+			return fmt.Errorf("invalid backend address %q: empty socket path", backend)
+		}
+		return nil
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		if strings.Count(address, ":") > 1 && !strings.HasPrefix(address, "[") {
+			return fmt.Errorf("invalid backend address %q: IPv6 addresses need brackets, e.g. [::1]:80", backend)
+		}
+		return fmt.Errorf("invalid backend address %q: %w", backend, err)
+	}
+	if !strings.Contains(port, "%P") {
+		if _, err := net.LookupPort("tcp", port); err != nil {
+			return fmt.Errorf("invalid backend address %q: %w", backend, err)
+		}
+	}
+	if strings.Contains(host, ":") {
+		if _, err := netip.ParseAddr(host); err != nil {
+			return fmt.Errorf("invalid backend address %q: %w", backend, err)
+		}
+	}
+	return nil
+}
+
+// nextBackends returns the healthy backends, starting with the next one in
+// round-robin order. If no backend is healthy, all of them are returned.
+func (p *Proxy) nextBackends() []string {
+	s := p.current.Load()
+	start := int((atomic.AddUint64(&p.nextBackend, 1) - 1) % uint64(len(s.backends)))
+
+	backends := make([]string, 0, len(s.backends))
+	for i := range s.backends {
+		j := (start + i) % len(s.backends)
+		if atomic.LoadInt32(&s.backendDown[j]) == 0 {
+			backends = append(backends, s.backends[j])
+		}
+	}
+	if len(backends) == 0 {
+		backends = append(backends, s.backends[start:]...)
+		backends = append(backends, s.backends[:start]...)
+	}
+	return backends
+}
+
+// checkBackendHealth probes every backend each interval until the proxy is
+// stopped, taking backends that refuse connections out of the rotation and
+// restoring them once they are reachable again.
+func (p *Proxy) checkBackendHealth(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s := p.current.Load()
+		for i, backend := range s.backends {
+			// without a connection, there is nothing to check
+			if isTemplate(backend) {
+				continue
+			}
+			conn, err := p.dialAddress(backendNetwork(backend))
+			if err == nil {
+				conn.Close()
+				if atomic.SwapInt32(&s.backendDown[i], 0) == 1 {
+					p.log.Info("backend healthy again", "backend", backend)
+				}
+			} else if atomic.SwapInt32(&s.backendDown[i], 1) == 0 {
+				p.log.Warn("backend unhealthy", "backend", backend, "err", err)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-p.shutdown:
+			return
+		}
+	}
+}
+
+// checkUnitActive returns an error unless all units are active, so the
+// backend isn't considered reachable before.
+func (p *Proxy) checkUnitActive() error {
+	if p.config.NoUnit {
+		return nil
+	}
+	unit, state, err := p.unitCtrl.inactiveUnit()
+	if err != nil {
+		return fmt.Errorf("checking the unit's state: %w", err)
+	}
+	if unit != "" {
+		return fmt.Errorf("connected, but %s is still %s", unit, state)
+	}
+	return nil
+}
+
+// retryDelay calculates the exponential backoff before the given retry
+// attempt, capped at the configured maximum delay.
+func (p *Proxy) retryDelay(attempt int) time.Duration {
+	s := p.current.Load()
+	delay := s.retryBaseDelay
+	for i := 1; i < attempt && delay < s.retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > s.retryMaxDelay {
+		delay = s.retryMaxDelay
+	}
+	return delay
+}
+
+// dialAddress connects to a backend address, through the SOCKS5 proxy if one
+// is configured, Unix sockets are always dialed directly.
+func (p *Proxy) dialAddress(network string, address string) (net.Conn, error) {
+	if p.socks5 != nil && network == "tcp" {
+		return p.dialSOCKS5(address)
+	}
+	return p.dialResolved(network, address)
+}
+
+// dialOneBackend connects to backend, doing the TLS handshake if TLS to the
+// backend is enabled. A failing handshake fails the connection attempt.
+func (p *Proxy) dialOneBackend(backend string) (net.Conn, error) {
+	network, address := backendNetwork(backend)
+	conn, err := p.dialAddress(network, address)
+	if err != nil || !p.config.BackendTLS {
+		return conn, err
+	}
+
+	config := &tls.Config{ServerName: p.config.BackendTLSServerName, InsecureSkipVerify: p.config.BackendTLSInsecure}
+	if config.ServerName == "" && network == "tcp" {
+		config.ServerName, _, _ = net.SplitHostPort(address)
+	}
+
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(p.config.DialTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with %s: %w", backend, err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// dialBackend connects to the next backend round-robin, skipping those that
+// can't be reached, or to route if it isn't empty. The addresses are expanded
+// with vars. If none can be reached, it retries with backoff while the
+// backends are starting up, for at most the backend timeout, or until deadline
+// if that isn't zero. Once a backend was reachable before, a failure is not
+// retried.
+func (p *Proxy) dialBackend(hadSuccessfulConnection bool, route string, vars backendVars, deadline time.Time) (net.Conn, error) {
+	startTime := time.Now()
+	attempt := 0
+	timeoutLogged := false
+
+	for {
+		var err error
+		backends := []string{route}
+		if route == "" {
+			backends = p.nextBackends()
+		}
+		for _, backend := range backends {
+			var connBackend net.Conn
+			backend = vars.expand(backend)
+			connBackend, err = p.dialOneBackend(backend)
+			if err == nil && !hadSuccessfulConnection {
+				// until the unit is up, another process may have the port
+				if err = p.checkUnitActive(); err != nil {
+					connBackend.Close()
+					break
+				}
+			}
+			if err == nil {
+				atomic.StoreInt64(&p.failedDials, 0)
+				atomic.StoreInt32(&p.backendReached, 1)
+				return connBackend, nil
+			}
+			atomic.AddInt64(&p.metrics.dialFailures, 1)
+			p.log.Debug("backend connection attempt failed", "backend", backend, "err", err)
+		}
+
+		// the backend was up already, so this is no startup delay worth waiting
+		// for, unless the unit died and is brought back now
+		if hadSuccessfulConnection {
+			if !p.config.RestartOnFailure || p.config.NoUnit || !p.restartAfterFailures() {
+				return nil, err
+			}
+			hadSuccessfulConnection = false
+			startTime = time.Now()
+		}
+
+		// a queued connection only has what is left of the queue timeout
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("connection waited longer than the queue timeout of %v: %w", p.config.QueueTimeout, err)
+		}
+
+		// Check if we've exceeded the backend timeout
+		if time.Since(startTime) > p.config.BackendTimeout {
+			switch p.config.BackendTimeoutAction {
+			case "keep-retrying":
+				if !timeoutLogged {
+					p.log.Warn("backend timeout exceeded, retrying anyway", "timeout", p.config.BackendTimeout, "err", err)
+					timeoutLogged = true
+				}
+			case "exit-error", "stop-unit":
+				p.log.Error("backend timeout exceeded, stopping", "timeout", p.config.BackendTimeout, "action", p.config.BackendTimeoutAction, "err", err)
+				p.stopBecause(stopBackendTimeout)
+				fallthrough
+			default:
+				atomic.StoreInt32(&p.backendGaveUp, 1)
+				return nil, fmt.Errorf("backend connection attempts exceeded timeout of %v: %w", p.config.BackendTimeout, err)
+			}
+		}
+
+		attempt++
+		if retryMax := p.current.Load().retryMax; retryMax > 0 && attempt > retryMax {
+			atomic.StoreInt32(&p.backendGaveUp, 1)
+			return nil, fmt.Errorf("backend connection failed after %d retries: %w", retryMax, err)
+		}
+
+		delay := p.retryDelay(attempt)
+		if !deadline.IsZero() && time.Until(deadline) < delay {
+			delay = time.Until(deadline)
+		}
+		p.log.Warn("backend connection attempt failed, retrying", "attempt", attempt, "delay", delay, "err", err)
+		// with keep-retrying, stopping the proxy is the only way out
+		select {
+		case <-time.After(delay):
+		case <-p.shutdown:
+			return nil, fmt.Errorf("proxy stopped while connecting to backend: %w", err)
+		}
+	}
+}
+
+// restartAfterFailures restarts the unit once enough connections in a row
+// failed to reach the backend, at most once per restart cooldown, whether it
+// is still active or not. It reports whether the unit was restarted.
+func (p *Proxy) restartAfterFailures() bool {
+	if atomic.AddInt64(&p.failedDials, 1) < restartAfterDialFailures {
+		return false
+	}
+
+	p.restartMu.Lock()
+	defer p.restartMu.Unlock()
+	if !p.lastRestart.IsZero() && time.Since(p.lastRestart) < p.config.RestartCooldown {
+		p.log.Debug("backend unreachable, but unit was restarted recently", "unit", p.config.Unit, "cooldown", p.config.RestartCooldown)
+		return false
+	}
+	p.lastRestart = time.Now()
+
+	p.log.Warn("backend unreachable, restarting unit", "unit", p.config.Unit, "failed_connections", atomic.LoadInt64(&p.failedDials))
+	if err := p.restartUnits("restart-on-failure"); err != nil {
+		p.log.Error("restarting unit failed", "unit", p.config.Unit, "err", err)
+		return false
+	}
+	atomic.StoreInt64(&p.failedDials, 0)
+	return true
+}
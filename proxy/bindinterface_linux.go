@@ -0,0 +1,18 @@
+package proxy
+
+import "syscall"
+
+// bindToInterface returns a dialer control function binding sockets to the
+// network interface with SO_BINDTODEVICE.
+func bindToInterface(name string) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var bindErr error
+		err := c.Control(func(fd uintptr) {
+			bindErr = syscall.BindToDevice(int(fd), name)
+		})
+		if err != nil {
+			return err
+		}
+		return bindErr
+	}, nil
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Check writes the socket activation environment and the resolved
+// configuration to w, followed by the problems found with them. It reports
+// whether the proxy looks ready to run.
+func (p *Proxy) Check(w io.Writer) bool {
+	fmt.Fprintf(w, "LISTEN_PID=%s (own pid %d)\n", os.Getenv("LISTEN_PID"), os.Getpid())
+	fmt.Fprintf(w, "LISTEN_FDS=%s\n", os.Getenv("LISTEN_FDS"))
+	fmt.Fprintf(w, "LISTEN_FDNAMES=%s\n", os.Getenv("LISTEN_FDNAMES"))
+	fmt.Fprintf(w, "unit: %s\n", p.config.Unit)
+	fmt.Fprintf(w, "destination: %s\n", strings.Join(p.current.Load().backends, ", "))
+
+	var problems []string
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		problems = append(problems, "LISTEN_PID is not this process, the sockets are meant for another one")
+	}
+
+	files, err := activatedFiles(p.config.FdName)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	for _, f := range files {
+		info, err := f.Stat()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("fd %d (%s): %v", f.Fd(), f.Name(), err))
+		} else if info.Mode()&os.ModeSocket == 0 {
+			problems = append(problems, fmt.Sprintf("fd %d (%s) is no socket", f.Fd(), f.Name()))
+		} else {
+			fmt.Fprintf(w, "fd %d (%s): socket\n", f.Fd(), f.Name())
+		}
+	}
+
+	for _, problem := range problems {
+		fmt.Fprintf(w, "problem: %s\n", problem)
+	}
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "activation looks correct")
+	}
+	return len(problems) == 0
+}
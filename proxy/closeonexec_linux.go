@@ -0,0 +1,9 @@
+package proxy
+
+import "syscall"
+
+// closeOnExec keeps a socket passed by systemd, which inherits them, from
+// leaking into the commands the proxy runs.
+func closeOnExec(fd int) {
+	syscall.CloseOnExec(fd)
+}
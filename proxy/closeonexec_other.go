@@ -0,0 +1,6 @@
+//go:build !linux
+
+package proxy
+
+// closeOnExec is only needed on Linux, where systemd passes the sockets.
+func closeOnExec(fd int) {}
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// coldStarted marks that the proxy just started units for a waiting client,
+// with lazy start or restart on failure, so the wait of the first client until
+// the backend is reached is measured.
+func (p *Proxy) coldStarted() {
+	atomic.StoreInt64(&p.coldStartAccepted, 0)
+	atomic.StoreInt32(&p.coldStart, 1)
+}
+
+// noteAccepted records when the first connection of a cold start was accepted,
+// connections are passed on in the order they were accepted.
+func (p *Proxy) noteAccepted(accepted time.Time) {
+	if atomic.LoadInt32(&p.coldStart) == 1 {
+		atomic.CompareAndSwapInt64(&p.coldStartAccepted, 0, accepted.UnixNano())
+	}
+}
+
+// noteBackendReached ends a cold start on the first connection that reached
+// the backend, logging and observing how long clients waited for it.
+func (p *Proxy) noteBackendReached(client string) {
+	if !atomic.CompareAndSwapInt32(&p.coldStart, 1, 0) {
+		return
+	}
+	accepted := atomic.LoadInt64(&p.coldStartAccepted)
+	if accepted == 0 {
+		return
+	}
+	latency := time.Since(time.Unix(0, accepted))
+	p.log.Info("cold start finished", "client", client, "latency", latency)
+	p.metrics.coldStarts.observe(latency.Seconds())
+}
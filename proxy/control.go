@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// controlStatus is the answer to the status command of the control socket.
+type controlStatus struct {
+	ActiveConnections int64           `json:"active_connections"`
+	LastActivity      time.Time       `json:"last_activity"`
+	UnitsStarted      []string        `json:"units_started"` // units started by the proxy
+	BackendReached    bool            `json:"backend_reached"`
+	Backends          []backendStatus `json:"backends"`
+}
+
+type backendStatus struct {
+	Address string `json:"address"`
+	Healthy bool   `json:"healthy"` // false if the last health check failed
+}
+
+func (p *Proxy) status() controlStatus {
+	status := controlStatus{
+		ActiveConnections: atomic.LoadInt64(&p.activeConnections),
+		LastActivity:      time.Unix(0, atomic.LoadInt64(&p.lastActivity)),
+		UnitsStarted:      []string{},
+		BackendReached:    atomic.LoadInt32(&p.backendReached) == 1,
+	}
+
+	p.unitsMu.Lock()
+	for unit := range p.startedUnits {
+		status.UnitsStarted = append(status.UnitsStarted, unit)
+	}
+	p.unitsMu.Unlock()
+	sort.Strings(status.UnitsStarted)
+
+	s := p.current.Load()
+	for i, backend := range s.backends {
+		status.Backends = append(status.Backends, backendStatus{backend, atomic.LoadInt32(&s.backendDown[i]) == 0})
+	}
+	return status
+}
+
+// startControlSocket answers commands on a Unix socket at path until the
+// returned function is called. Every line sent is a command, answered by a
+// line of JSON: status reports the state of the proxy, stop (or drain) stops
+// it like Stop does.
+func (p *Proxy) startControlSocket(path string) (func(), error) {
+	// the socket of a proxy that didn't exit cleanly is in the way
+	if info, err := os.Stat(path); err == nil && info.Mode().Type() == fs.ModeSocket {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					p.log.Error("accepting control connection failed", "err", err)
+				}
+				return
+			}
+			go p.serveControl(conn)
+		}
+	}()
+	p.log.Info("serving control socket", "path", path)
+
+	return func() { l.Close() }, nil
+}
+
+func (p *Proxy) serveControl(conn net.Conn) {
+	defer conn.Close()
+
+	encoder := json.NewEncoder(conn)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var err error
+		switch command := strings.TrimSpace(scanner.Text()); command {
+		case "":
+			continue
+		case "status":
+			err = encoder.Encode(p.status())
+		case "stop", "drain":
+			p.log.Info("stop requested on control socket")
+			p.stopBecause("control socket")
+			err = encoder.Encode(map[string]bool{"ok": true})
+		default:
+			err = encoder.Encode(map[string]string{"error": fmt.Sprintf("unknown command %q, available: status, stop", command)})
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// dryRunUnits stands in for systemd without a bus: it logs the calls a
+// unitController would make and keeps the state of the units in memory, so
+// the proxy behaves as if they were started and stopped.
+type dryRunUnits struct {
+	unitnames []string // started in this order, stopped in reverse
+	log       *slog.Logger
+	startMode string
+	stopMode  string
+
+	mu     sync.Mutex
+	active map[string]bool
+}
+
+func newDryRunUnits(names []string, startMode string, stopMode string, logger *slog.Logger) *dryRunUnits {
+	return &dryRunUnits{unitnames: names, log: logger, startMode: startMode, stopMode: stopMode, active: make(map[string]bool)}
+}
+
+// call logs a unit method call instead of making it.
+func (d *dryRunUnits) call(method string, unit string, args ...any) {
+	d.log.Info("dry run, not calling D-Bus", append([]any{"method", "org.freedesktop.systemd1.Manager." + method, "unit", unit}, args...)...)
+}
+
+func (d *dryRunUnits) startSystemdUnit() ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var units []string
+	for _, unit := range d.unitnames {
+		if d.active[unit] {
+			continue
+		}
+		d.call("StartUnit", unit, "mode", jobMode(d.startMode))
+		d.active[unit] = true
+		units = append(units, unit)
+	}
+	return units, nil
+}
+
+func (d *dryRunUnits) restartSystemdUnit() ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, unit := range d.unitnames {
+		d.call("RestartUnit", unit, "mode", jobMode(d.startMode))
+		d.active[unit] = true
+	}
+	return d.unitnames, nil
+}
+
+func (d *dryRunUnits) stopSystemdUnit(units []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i := len(units) - 1; i >= 0; i-- {
+		d.call("StopUnit", units[i], "mode", jobMode(d.stopMode))
+		delete(d.active, units[i])
+	}
+	return nil
+}
+
+func (d *dryRunUnits) killSystemdUnit(signal int32, units []string) error {
+	for i := len(units) - 1; i >= 0; i-- {
+		d.call("KillUnit", units[i], "signal", signal)
+	}
+	return nil
+}
+
+func (d *dryRunUnits) inactiveUnit() (string, string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, unit := range d.unitnames {
+		if !d.active[unit] {
+			return unit, "inactive", nil
+		}
+	}
+	return "", "", nil
+}
+
+// waitUntilActive returns right away, started units are active at once.
+func (d *dryRunUnits) waitUntilActive(timeout time.Duration) error {
+	return nil
+}
+
+func (d *dryRunUnits) checkUnitsExist() error {
+	for _, unit := range d.unitnames {
+		d.call("LoadUnit", unit)
+	}
+	return nil
+}
+
+func (d *dryRunUnits) Close() error {
+	return nil
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// execConn is a command run for a single connection, inetd style: writes go to
+// its stdin and reads come from its stdout. The pipes support deadlines like
+// sockets do, so it is proxied like any backend connection.
+type execConn struct {
+	cmd    *exec.Cmd
+	stdin  *os.File // our end of the command's stdin
+	stdout *os.File // our end of the command's stdout
+	exited chan struct{}
+}
+
+// execAddr is the address of an execConn, the command's path.
+type execAddr string
+
+func (a execAddr) Network() string { return "exec" }
+func (a execAddr) String() string  { return string(a) }
+
+// spawnBackend starts the -exec command for the connection of client. Its stderr
+// is passed through, so its messages end up in the log of the proxy.
+func (p *Proxy) spawnBackend(client string) (*execConn, error) {
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		return nil, err
+	}
+
+	cmd := exec.Command(p.execArgs[0], p.execArgs[1:]...)
+	cmd.Stdin = stdinR
+	cmd.Stdout = stdoutW
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	// the command has its own copies of these now
+	stdinR.Close()
+	stdoutW.Close()
+	if err != nil {
+		stdinW.Close()
+		stdoutR.Close()
+		return nil, err
+	}
+	p.log.Debug("command started", "client", client, "pid", cmd.Process.Pid)
+
+	c := &execConn{cmd: cmd, stdin: stdinW, stdout: stdoutR, exited: make(chan struct{})}
+	go func() {
+		err := cmd.Wait()
+		p.log.Debug("command exited", "client", client, "pid", cmd.Process.Pid, "err", err)
+		close(c.exited)
+	}()
+	return c, nil
+}
+
+func (c *execConn) Read(b []byte) (int, error)  { return c.stdout.Read(b) }
+func (c *execConn) Write(b []byte) (int, error) { return c.stdin.Write(b) }
+
+// CloseWrite closes the command's stdin, so it sees the end of its input.
+func (c *execConn) CloseWrite() error { return c.stdin.Close() }
+
+// Close kills the command unless it exited already, and waits for it.
+func (c *execConn) Close() error {
+	c.stdin.Close()
+	c.stdout.Close()
+	select {
+	case <-c.exited:
+	default:
+		c.cmd.Process.Kill()
+		<-c.exited
+	}
+	return nil
+}
+
+func (c *execConn) LocalAddr() net.Addr  { return execAddr(c.cmd.Path) }
+func (c *execConn) RemoteAddr() net.Addr { return execAddr(c.cmd.Path) }
+
+func (c *execConn) SetDeadline(t time.Time) error {
+	c.stdin.SetWriteDeadline(t)
+	return c.stdout.SetReadDeadline(t)
+}
+func (c *execConn) SetReadDeadline(t time.Time) error  { return c.stdout.SetReadDeadline(t) }
+func (c *execConn) SetWriteDeadline(t time.Time) error { return c.stdin.SetWriteDeadline(t) }
+
+// noHalfClose hides the CloseWrite method of a client connection, so the end
+// of the command's output ends the whole connection, like inetd does.
+type noHalfClose struct {
+	net.Conn
+}
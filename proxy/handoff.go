@@ -0,0 +1,24 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// handOffConnection passes an accepted connection to the backend listening on
+// the fd handoff socket, instead of proxying it. The socket is dialed like any
+// backend, so it is retried until the unit is up.
+func (p *Proxy) handOffConnection(connOutwards net.Conn, client string, hadSuccessfulConnection bool) error {
+	connControl, err := p.dialBackend(hadSuccessfulConnection, "unix:"+p.config.FdHandoffSocket, backendVars{}, time.Time{})
+	if err != nil {
+		return err
+	}
+	defer connControl.Close()
+
+	control, ok := connControl.(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("fd handoff socket %s is no Unix socket", p.config.FdHandoffSocket)
+	}
+	return passConnection(control, connOutwards, client)
+}
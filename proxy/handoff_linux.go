@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// passConnection sends the file descriptor of conn over control as SCM_RIGHTS,
+// with the client address as message.
+func passConnection(control *net.UnixConn, conn net.Conn, client string) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("can't pass %T connections", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	// send within Control, so the descriptor stays valid until it is duplicated
+	var sendErr error
+	err = raw.Control(func(fd uintptr) {
+		_, _, sendErr = control.WriteMsgUnix([]byte(client), syscall.UnixRights(int(fd)), nil)
+	})
+	if err != nil {
+		return err
+	}
+	return sendErr
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+// passConnection is only supported on Linux.
+func passConnection(control *net.UnixConn, conn net.Conn, client string) error {
+	return errors.New("passing connections is only supported on Linux")
+}
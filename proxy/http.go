@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxHTTPHeaderBytes limits the size of the request head read for routing.
+const maxHTTPHeaderBytes = 64 * 1024
+
+// httpHeaderTimeout bounds the time a client may take to send its request head,
+// with TLS termination including the handshake, which the first read drives.
+const httpHeaderTimeout = 10 * time.Second
+
+// peekHTTPHost reads the head of the first HTTP request from conn and returns
+// the requested host along with all bytes read, which still have to be passed
+// on to the backend unchanged. It blocks for up to httpHeaderTimeout, so it
+// must not run in the accept loop.
+func peekHTTPHost(conn net.Conn) (string, []byte, error) {
+	conn.SetReadDeadline(time.Now().Add(httpHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var peeked []byte
+	buffer := make([]byte, 4096)
+	for !bytes.Contains(peeked, []byte("\r\n\r\n")) {
+		if len(peeked) > maxHTTPHeaderBytes {
+			return "", nil, errors.New("HTTP request head too large")
+		}
+		n, err := conn.Read(buffer)
+		peeked = append(peeked, buffer[:n]...)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	host, err := requestHost(peeked)
+	return host, peeked, err
+}
+
+// requestHost returns the lower-cased host of an HTTP request head without
+// the port, taken from the Host header or an absolute request URL.
+func requestHost(head []byte) (string, error) {
+	lines := strings.Split(string(head[:bytes.Index(head, []byte("\r\n\r\n"))]), "\r\n")
+
+	requestLine := strings.Fields(lines[0])
+	if len(requestLine) != 3 || !strings.HasPrefix(requestLine[2], "HTTP/") {
+		return "", fmt.Errorf("malformed HTTP request line %q", lines[0])
+	}
+
+	host := ""
+	if u, err := url.Parse(requestLine[1]); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if ok && host == "" && strings.EqualFold(strings.TrimSpace(name), "host") {
+			host = strings.TrimSpace(value)
+		}
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.Trim(host, "[]")), nil
+}
+
+// writeBadGateway answers a request that can't be routed to any backend.
+func writeBadGateway(conn net.Conn, host string) {
+	body := fmt.Sprintf("no backend for host %q\n", host)
+	conn.SetWriteDeadline(time.Now().Add(httpHeaderTimeout))
+	fmt.Fprintf(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+}
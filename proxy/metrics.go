@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metrics are the counters exposed in the Prometheus text format, all accessed atomically.
+type metrics struct {
+	activations  int64
+	connections  int64
+	dialFailures int64
+	bytesIn      int64 // client to backend
+	bytesOut     int64 // backend to client
+
+	clientErrors  int64 // connections broken by the client, e.g. resets
+	backendErrors int64 // connections broken by the backend, e.g. because it crashed
+
+	coldStarts histogram // seconds clients waited for the backend after a lazy start or restart, not atomic
+}
+
+// coldStartBuckets are the upper bounds of the cold start histogram in seconds.
+var coldStartBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// histogram counts observations in cumulative buckets like a Prometheus histogram.
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64 // per bucket of coldStartBuckets, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.counts == nil {
+		h.counts = make([]uint64, len(coldStartBuckets))
+	}
+	for i, bound := range coldStartBuckets {
+		if value <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// write writes the histogram in the Prometheus text exposition format.
+func (h *histogram) write(w io.Writer, name string, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative uint64
+	for i, bound := range coldStartBuckets {
+		if h.counts != nil {
+			cumulative += h.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, h.sum, name, h.count)
+}
+
+// serveMetrics writes the metrics in the Prometheus text exposition format.
+func (p *Proxy) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeMetric(w, "socket_activate_unit_activations_total", "counter", "Number of times the unit was started.", atomic.LoadInt64(&p.metrics.activations))
+	writeMetric(w, "socket_activate_connections_total", "counter", "Number of accepted connections.", atomic.LoadInt64(&p.metrics.connections))
+	writeMetric(w, "socket_activate_active_connections", "gauge", "Number of currently open connections.", atomic.LoadInt64(&p.activeConnections))
+	writeMetric(w, "socket_activate_dial_failures_total", "counter", "Number of failed backend connection attempts.", atomic.LoadInt64(&p.metrics.dialFailures))
+
+	fmt.Fprintln(w, "# HELP socket_activate_bytes_proxied_total Number of bytes proxied.")
+	fmt.Fprintln(w, "# TYPE socket_activate_bytes_proxied_total counter")
+	fmt.Fprintf(w, "socket_activate_bytes_proxied_total{direction=\"in\"} %d\n", atomic.LoadInt64(&p.metrics.bytesIn))
+	fmt.Fprintf(w, "socket_activate_bytes_proxied_total{direction=\"out\"} %d\n", atomic.LoadInt64(&p.metrics.bytesOut))
+
+	fmt.Fprintln(w, "# HELP socket_activate_connection_errors_total Number of proxied connections that broke, by the side they broke on.")
+	fmt.Fprintln(w, "# TYPE socket_activate_connection_errors_total counter")
+	fmt.Fprintf(w, "socket_activate_connection_errors_total{side=\"client\"} %d\n", atomic.LoadInt64(&p.metrics.clientErrors))
+	fmt.Fprintf(w, "socket_activate_connection_errors_total{side=\"backend\"} %d\n", atomic.LoadInt64(&p.metrics.backendErrors))
+
+	p.metrics.coldStarts.write(w, "socket_activate_cold_start_seconds", "Time from the first connection waiting for a lazy start or restart of the unit until the backend was reached.")
+}
+
+func writeMetric(w io.Writer, name string, kind string, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
+
+// startMetricsServer serves the metrics on addr until the returned function is called.
+func (p *Proxy) startMetricsServer(addr string) (func(), error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", p.serveMetrics)
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			p.log.Error("serving metrics failed", "err", err)
+		}
+	}()
+	p.log.Info("serving metrics", "addr", l.Addr())
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}, nil
+}
@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// peerCredentials describes the process on the other end of a Unix socket
+// connection, as those have no meaningful remote address.
+func peerCredentials(conn *net.UnixConn) (string, bool) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return "", false
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return "", false
+	}
+	return fmt.Sprintf("pid=%d,uid=%d", cred.Pid, cred.Uid), true
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package proxy
+
+import "net"
+
+// peerCredentials is only supported on Linux.
+func peerCredentials(conn *net.UnixConn) (string, bool) {
+	return "", false
+}
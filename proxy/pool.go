@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// poolProbeTimeout is how long a pooled connection is read from to check it is
+// still open before handing it to a client.
+const poolProbeTimeout = time.Millisecond
+
+// poolable checks that backends can be pooled, which those depending on the
+// connection can't.
+func poolable(backends []string) error {
+	for _, backend := range backends {
+		if isTemplate(backend) {
+			return fmt.Errorf("backend %s depends on the connection, it can't be pooled", backend)
+		}
+	}
+	return nil
+}
+
+// fillPool keeps up to BackendPoolSize connections to the default backends open
+// for clients to take, dialing a new one whenever one was taken, until the
+// proxy is stopped.
+func (p *Proxy) fillPool() {
+	defer func() {
+		for {
+			select {
+			case conn := <-p.pool:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	}()
+
+	attempt := 0
+	for {
+		// only dial once there is room, the pool is filled by nothing else
+		for len(p.pool) == cap(p.pool) {
+			select {
+			case <-p.poolTaken:
+			case <-p.shutdown:
+				return
+			}
+		}
+
+		s := p.current.Load()
+		backend := p.nextBackends()[0]
+		conn, err := p.dialOneBackend(backend)
+		if err != nil {
+			attempt++
+			delay := p.retryDelay(attempt)
+			p.log.Debug("connecting pooled backend connection failed, retrying", "backend", backend, "delay", delay, "err", err)
+			select {
+			case <-time.After(delay):
+				continue
+			case <-p.shutdown:
+				return
+			}
+		}
+		attempt = 0
+		if !slices.Equal(p.current.Load().backends, s.backends) {
+			// reloaded while dialing, the connection may go to an old backend
+			conn.Close()
+			continue
+		}
+		p.tuneConnection(conn)
+
+		select {
+		case p.pool <- conn:
+		case <-p.shutdown:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// emptyPool closes the pooled connections, e.g. because they go to backends
+// that were reloaded away, for fillPool to dial new ones.
+func (p *Proxy) emptyPool() {
+	for {
+		select {
+		case conn := <-p.pool:
+			conn.Close()
+			select {
+			case p.poolTaken <- struct{}{}:
+			default:
+			}
+		default:
+			return
+		}
+	}
+}
+
+// takePooled returns an open connection from the pool, or nil if there is none.
+func (p *Proxy) takePooled() net.Conn {
+	for {
+		select {
+		case conn := <-p.pool:
+			select {
+			case p.poolTaken <- struct{}{}:
+			default:
+			}
+			if err := probePooled(conn); err != nil {
+				p.log.Debug("pooled backend connection is gone", "backend", conn.RemoteAddr(), "err", err)
+				conn.Close()
+				continue
+			}
+			atomic.StoreInt32(&p.backendReached, 1)
+			return conn
+		default:
+			return nil
+		}
+	}
+}
+
+// probePooled checks that conn is still open, by reading with a deadline that
+// must pass without the backend closing the connection. A backend talking
+// first can't be pooled, as the client would miss what it said.
+func probePooled(conn net.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(poolProbeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var b [1]byte
+	n, err := conn.Read(b[:])
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil
+	}
+	if n > 0 {
+		return errors.New("backend sent data unasked")
+	}
+	return err
+}
@@ -0,0 +1,819 @@
+// Package proxy implements the socket activation proxy: it starts a systemd
+// unit, takes over the sockets passed by systemd and forwards their traffic to
+// the unit's backend, stopping the unit again once it is idle.
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	netproxy "golang.org/x/net/proxy"
+)
+
+// DefaultBufferSize is the copy buffer size used if Config.BufferSize is not positive.
+const DefaultBufferSize = 32 * 1024
+
+// DefaultUDPClientTimeout is the UDP client expiry used if Config.UDPClientTimeout is not positive.
+const DefaultUDPClientTimeout = time.Minute
+
+var (
+	// ErrUnitFailed is matched by the error of Start if the unit failed to start.
+	ErrUnitFailed = errors.New("unit failed to start")
+	// ErrBackendUnreachable is matched by the error of Start if connections
+	// were given up on because the backend never became reachable, or the
+	// backend timeout action stopped the proxy.
+	ErrBackendUnreachable = errors.New("backend never became reachable")
+)
+
+// Config holds the settings of a Proxy.
+type Config struct {
+	Mode        string // tcp, udp or http
+	Unit        string // unit to start, may be a template, comma-separated to start several together
+	Instance    string // instance to start if Unit is a template
+	User        bool   // manage the unit on the session bus instead of the system bus
+	DBusAddress string // address of the bus to manage the unit on, overrides User
+	StartMode   string // job mode for starting the unit, e.g. replace or fail, defaults to replace
+	StopMode    string // job mode for stopping the unit, e.g. replace or replace-irreversibly, defaults to replace
+
+	PreStopSignal string        // signal to send the unit before stopping it, e.g. SIGUSR1, empty to just stop it
+	PreStopGrace  time.Duration // time between PreStopSignal and stopping the unit
+	Destination   string        // comma-separated backend addresses, Unix sockets if prefixed with "unix:" or an absolute path
+	Listen        string        // address to listen on instead of using the sockets passed by systemd, e.g. for testing
+	NoUnit        bool          // don't manage the unit at all, just proxy
+	DryRun        bool          // log the calls managing the unit instead of making them
+	LazyStart     bool          // start the unit only once the first client connects
+
+	Timeout        time.Duration // inactivity timeout after which to stop the unit, 0 to never stop it
+	MaxLifetime    time.Duration // stop the unit after running that long regardless of activity, 0 to disable
+	MinLifetime    time.Duration // don't stop the unit for inactivity before it ran that long
+	NoStop         bool          // never stop the unit, e.g. because it is shared with other activators
+	LockDir        string        // directory to register activators of the unit in, only the last one stops it, empty to disable
+	BackendTimeout time.Duration // maximum time a connection waits for the backend
+	DialTimeout    time.Duration // timeout of a single backend connection attempt
+	ResolveTTL     time.Duration // how long to cache the addresses of backend hostnames, 0 to resolve every time
+	HEDelay        time.Duration // head start of each address of a hostname before racing the next (Happy Eyeballs), 0 to try them in turn
+	RetryMax       int           // maximum number of backend connection retries, 0 for no limit
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+	DrainTimeout   time.Duration // maximum time to wait for open connections on stop
+
+	StopOnlyIfStarted bool // only stop units the proxy started, not those that were active already
+
+	MinBytesPerInterval int64 // stop the unit once fewer bytes were proxied within Timeout, even with open connections, 0 to disable
+
+	// what to do when a connection waited BackendTimeout for the backend: drop
+	// (the connection), exit-error, stop-unit (and exit with an error) or keep-retrying
+	BackendTimeoutAction string
+
+	RestartOnFailure bool          // start the unit again if the backend becomes unreachable
+	RestartCooldown  time.Duration // minimum time between such restarts
+
+	Warmup       int    // probes every backend must pass in a row before clients are forwarded, 0 to disable
+	WarmupSend   string // payload to send as probe, Go escape sequences like \r\n are interpreted, empty to only connect
+	WarmupExpect string // text the response to WarmupSend must contain, any response if empty
+
+	PauseAccept bool // don't accept connections before every backend can be connected to, at least one probe
+
+	ConnIdleTimeout time.Duration // close connections without any transfer for that long, 0 to never close them
+	HealthInterval  time.Duration // interval between backend health checks, 0 to disable them
+	MaxConns        int           // maximum number of concurrently proxied connections, 0 for no limit
+	MaxConnsAction  string        // what to do with new connections at MaxConns: wait or reject
+
+	ClientIdleTimeout  time.Duration // close connections whose client sent nothing for that long, 0 to disable
+	BackendIdleTimeout time.Duration // close connections whose backend sent nothing for that long, 0 to disable
+
+	UDPClientTimeout time.Duration // forget UDP clients and close their backend socket after that long without datagrams
+
+	QueueSize    int           // connections to park while the backend wasn't reached yet
+	QueueTimeout time.Duration // maximum time a connection stays parked, 0 to dial for each connection without queue
+
+	AcceptRate       float64 // new connections accepted per second, 0 for no limit
+	AcceptBurst      int     // connections accepted at once before AcceptRate applies
+	AcceptRateAction string  // what to do with new connections above AcceptRate: wait or reject
+
+	AllowCIDR string // comma-separated CIDRs clients may connect from, empty to allow all
+	DenyCIDR  string // comma-separated CIDRs clients may not connect from, taking precedence over AllowCIDR
+
+	KeepAlive           time.Duration // TCP keepalive period, 0 to disable keepalive
+	NoDelay             bool          // disable Nagle's algorithm on TCP connections
+	ProxyProtocol       string        // PROXY protocol version (v1 or v2) to announce clients to the backend with, empty to disable
+	AcceptProxyProtocol bool          // expect a PROXY protocol header from whoever connects, e.g. a load balancer
+
+	TLSCert string // certificate file to terminate TLS on the activated sockets with, empty to disable
+	TLSKey  string // key file of TLSCert
+
+	BackendTLS           bool   // connect to the backend via TLS
+	BackendTLSServerName string // server name to send and verify, defaults to the backend host
+	BackendTLSInsecure   bool   // skip verifying the backend certificate
+
+	BackendLocalAddr string // local IP address to connect to backends from, empty to let the system choose
+	BackendInterface string // network interface to bind backend connections to, empty for any
+
+	BackendSOCKS5 string // SOCKS5 proxy to connect to TCP backends through, as [user:password@]host:port, empty to connect directly
+
+	BackendPoolSize int // backend connections to keep open for clients to take once the unit is up, 0 to dial for each client
+
+	SNIMap string // comma-separated servername=backend pairs to route TLS connections by, others go to Destination
+
+	HTTPMap     string // comma-separated host=backend pairs to route HTTP requests by in http mode
+	HTTPDefault string // backend for hosts missing in HTTPMap, empty to answer them with 502
+
+	FdHandoffSocket string // Unix socket to pass accepted connections to instead of proxying them, empty to proxy
+
+	Exec string // command to run for each connection on its stdin and stdout instead of connecting to a backend, empty to connect
+
+	Transparent bool // forward connections to their original destination before a TPROXY or REDIRECT rule, instead of to the backends
+
+	RouteExpr string // expression picking the backend of each TCP connection, empty or an empty result for the usual routing
+
+	BufferSize int    // copy buffer size for each direction of a connection
+	FdName     string // only use the activated sockets with this name
+
+	MetricsAddr string // address to serve Prometheus metrics on, empty to disable
+	AuditLog    string // file to append a JSON line per start and stop of the units to, empty to disable
+
+	ControlSocket string // Unix socket to answer status queries and stop commands on, empty to disable
+
+	Logger *slog.Logger // defaults to slog.Default()
+}
+
+// Proxy forwards the sockets passed by systemd to the backend of a unit.
+type Proxy struct {
+	activeConnections int64 // accessed atomically, first for alignment
+	lastActivity      int64 // accessed atomically, time of the last activity in Unix nanoseconds
+	metrics           metrics
+	nextBackend       uint64 // accessed atomically, round-robin position in backends
+	failedDials       int64  // accessed atomically, connections in a row that couldn't reach a backend
+	backendReached    int32  // accessed atomically, 1 once any connection reached a backend
+	backendGaveUp     int32  // accessed atomically, 1 once a connection gave up waiting for the backend
+	coldStartAccepted int64  // accessed atomically, when the first connection of a cold start was accepted in Unix nanoseconds
+	coldStart         int32  // accessed atomically, 1 after starting units until a connection reached the backend
+
+	config   Config
+	units    []string                 // the units to start, in order
+	current  atomic.Pointer[settings] // replaced by Reload
+	resolver resolver
+	unitCtrl unitManager // nil with NoUnit
+	log      *slog.Logger
+
+	tlsConfig     *tls.Config            // terminates TLS of clients, nil to proxy as is
+	certs         *certReloader          // certificate of tlsConfig, nil without it
+	warmupSend    []byte                 // unquoted WarmupSend, nil to only connect
+	preStopSignal int32                  // parsed PreStopSignal, 0 if unset
+	socks5        netproxy.ContextDialer // dialer of BackendSOCKS5, nil to connect directly
+	sniRoutes     map[string]string      // backends by TLS server name, nil without SNI routing
+	httpRoutes    map[string]string      // backends by HTTP host in http mode
+	routeExpr     *routeExpr             // picks the backend of each connection, nil without RouteExpr
+
+	localAddr netip.Addr // parsed BackendLocalAddr, invalid if unset
+	// binds backend connections to BackendInterface, nil if unset
+	bindInterface func(network, address string, c syscall.RawConn) error
+
+	execArgs []string // split Exec with the path of the command looked up, nil to connect to backends
+
+	startOnce sync.Once
+	startErr  error // why the lazily started unit failed to start
+
+	restartMu   sync.Mutex
+	lastRestart time.Time // last restart on failure
+
+	unitsMu      sync.Mutex
+	startedUnits map[string]bool // units started by the proxy, not active before
+	lastStart    time.Time       // when the proxy last started units
+
+	auditLog   *auditLog // nil without AuditLog
+	stopReason string    // why the proxy was stopped, set before shutdown is closed
+
+	buffers sync.Pool // copy buffers of BufferSize, as *[]byte
+
+	proxiedMu sync.Mutex
+	proxied   map[net.Conn]struct{} // both sides of the connections being proxied
+
+	connSlots    chan struct{}    // semaphore limiting concurrent connections, nil without limit
+	acceptLimit  *rateLimiter     // limits the rate of new connections, nil without limit
+	queue        chan pendingConn // connections waiting for the backend to come up, nil without queue
+	pool         chan net.Conn    // open backend connections ready to be taken, nil without pool
+	poolTaken    chan struct{}    // signals fillPool that a connection was taken from pool
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+}
+
+// New validates config and returns a Proxy using it.
+func New(config Config) (*Proxy, error) {
+	if config.Mode != "tcp" && config.Mode != "udp" && config.Mode != "http" {
+		return nil, fmt.Errorf("unknown mode %q, available: tcp, udp, http", config.Mode)
+	}
+
+	logger := config.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	if config.BufferSize <= 0 {
+		logger.Warn("invalid buffer size, using default", "buffer_size", config.BufferSize, "default", DefaultBufferSize)
+		config.BufferSize = DefaultBufferSize
+	}
+	if config.Mode == "udp" && config.UDPClientTimeout <= 0 {
+		logger.Warn("invalid UDP client timeout, using default", "udp_client_timeout", config.UDPClientTimeout, "default", DefaultUDPClientTimeout)
+		config.UDPClientTimeout = DefaultUDPClientTimeout
+	}
+
+	if config.MaxConnsAction != "wait" && config.MaxConnsAction != "reject" {
+		return nil, fmt.Errorf("unknown max connections action %q, available: wait, reject", config.MaxConnsAction)
+	}
+	if config.AcceptRateAction != "wait" && config.AcceptRateAction != "reject" {
+		return nil, fmt.Errorf("unknown accept rate action %q, available: wait, reject", config.AcceptRateAction)
+	}
+	switch config.BackendTimeoutAction {
+	case "", "drop", "exit-error", "stop-unit", "keep-retrying":
+	default:
+		return nil, fmt.Errorf("unknown backend timeout action %q, available: drop, exit-error, stop-unit, keep-retrying", config.BackendTimeoutAction)
+	}
+	if config.AcceptRate < 0 {
+		return nil, fmt.Errorf("invalid accept rate %v", config.AcceptRate)
+	}
+
+	if config.ProxyProtocol != "" && config.ProxyProtocol != "v1" && config.ProxyProtocol != "v2" {
+		return nil, fmt.Errorf("unknown PROXY protocol version %q, available: v1, v2", config.ProxyProtocol)
+	}
+
+	if config.FdHandoffSocket != "" && (config.Mode != "tcp" || config.TLSCert != "" || config.SNIMap != "" || config.BackendTLS || config.ProxyProtocol != "") {
+		return nil, errors.New("fd handoff only works in tcp mode, without TLS, SNI routing or PROXY protocol headers to the backend")
+	}
+	if config.Exec != "" && (config.Mode != "tcp" || config.FdHandoffSocket != "" || config.BackendTLS) {
+		return nil, errors.New("running a command per connection only works in tcp mode, without fd handoff or TLS to the backend")
+	}
+
+	if config.StartMode != "" {
+		if err := validJobMode(config.StartMode, startJobModes); err != nil {
+			return nil, fmt.Errorf("start mode: %w", err)
+		}
+	}
+	if config.StopMode != "" {
+		if err := validJobMode(config.StopMode, stopJobModes); err != nil {
+			return nil, fmt.Errorf("stop mode: %w", err)
+		}
+	}
+
+	var units []string
+	for _, unit := range strings.Split(config.Unit, ",") {
+		unitName, err := instanceUnitName(strings.TrimSpace(unit), config.Instance)
+		if err != nil {
+			return nil, err
+		}
+		units = append(units, unitName)
+	}
+	config.Unit = strings.Join(units, ",")
+
+	current, err := newSettings(config)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Proxy{
+		config:   config,
+		units:    units,
+		log:      logger,
+		resolver: resolver{ttl: config.ResolveTTL},
+		shutdown: make(chan struct{}),
+	}
+	p.current.Store(current)
+	p.buffers.New = func() any {
+		buffer := make([]byte, config.BufferSize)
+		return &buffer
+	}
+	if config.MaxConns > 0 {
+		p.connSlots = make(chan struct{}, config.MaxConns)
+	}
+	if config.QueueTimeout > 0 {
+		if config.QueueSize <= 0 {
+			return nil, fmt.Errorf("invalid queue size %d", config.QueueSize)
+		}
+		p.queue = make(chan pendingConn, config.QueueSize)
+	}
+	if config.AcceptRate > 0 {
+		p.acceptLimit = newRateLimiter(config.AcceptRate, config.AcceptBurst)
+	}
+	if config.Transparent && (config.Mode != "tcp" || config.SNIMap != "" || config.Exec != "" || config.FdHandoffSocket != "") {
+		return nil, errors.New("forwarding to the original destination only works in tcp mode, without SNI routing, fd handoff or a command per connection")
+	}
+	if config.RouteExpr != "" {
+		if config.Mode == "udp" || config.Exec != "" || config.FdHandoffSocket != "" {
+			return nil, errors.New("a route expression only works for TCP connections to a backend, without fd handoff or a command per connection")
+		}
+		var err error
+		if p.routeExpr, err = compileRouteExpr(config.RouteExpr); err != nil {
+			return nil, fmt.Errorf("route expression: %w", err)
+		}
+	}
+	if config.MinBytesPerInterval > 0 && config.Timeout == 0 {
+		return nil, errors.New("a minimum throughput needs an inactivity timeout as interval")
+	}
+	if config.BackendPoolSize > 0 {
+		if config.Mode != "tcp" || config.SNIMap != "" || config.Exec != "" || config.FdHandoffSocket != "" {
+			return nil, errors.New("a backend pool only works in tcp mode, without SNI routing, fd handoff or a command per connection")
+		}
+		if err := poolable(current.backends); err != nil {
+			return nil, err
+		}
+		p.pool = make(chan net.Conn, config.BackendPoolSize)
+		p.poolTaken = make(chan struct{}, 1)
+	}
+
+	if config.TLSCert != "" || config.TLSKey != "" {
+		if config.TLSCert == "" || config.TLSKey == "" {
+			return nil, errors.New("TLS needs both a certificate and a key")
+		}
+		certs, err := newCertReloader(config.TLSCert, config.TLSKey, logger)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS certificate: %w", err)
+		}
+		p.certs = certs
+		p.tlsConfig = &tls.Config{GetCertificate: certs.getCertificate}
+	}
+
+	if config.PreStopSignal != "" {
+		p.preStopSignal, err = signalNumber(config.PreStopSignal)
+		if err != nil {
+			return nil, fmt.Errorf("pre-stop signal: %w", err)
+		}
+	}
+
+	if config.BackendLocalAddr != "" {
+		p.localAddr, err = netip.ParseAddr(config.BackendLocalAddr)
+		if err != nil {
+			return nil, fmt.Errorf("backend local address: %w", err)
+		}
+	}
+	if config.BackendInterface != "" {
+		if _, err := net.InterfaceByName(config.BackendInterface); err != nil {
+			return nil, fmt.Errorf("backend interface: %w", err)
+		}
+		p.bindInterface, err = bindToInterface(config.BackendInterface)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if args := strings.Fields(config.Exec); len(args) > 0 {
+		p.execArgs = args
+		if p.execArgs[0], err = exec.LookPath(p.execArgs[0]); err != nil {
+			return nil, fmt.Errorf("command to run per connection: %w", err)
+		}
+	}
+
+	if config.BackendSOCKS5 != "" {
+		p.socks5, err = p.newSOCKS5(config.BackendSOCKS5)
+		if err != nil {
+			return nil, fmt.Errorf("backend SOCKS5 proxy: %w", err)
+		}
+	}
+
+	if config.WarmupSend != "" {
+		send, err := strconv.Unquote(`"` + config.WarmupSend + `"`)
+		if err != nil {
+			return nil, fmt.Errorf("invalid warmup payload %q: %w", config.WarmupSend, err)
+		}
+		p.warmupSend = []byte(send)
+	}
+
+	if config.SNIMap != "" {
+		if p.tlsConfig != nil {
+			return nil, errors.New("SNI routing passes TLS through, it can't be combined with TLS termination")
+		}
+		if config.Mode == "http" {
+			return nil, errors.New("SNI routing needs the TLS handshake, it can't be combined with http mode")
+		}
+		p.sniRoutes, err = parseRouteMap(config.SNIMap)
+		if err != nil {
+			return nil, fmt.Errorf("SNI map: %w", err)
+		}
+	}
+
+	if config.Mode == "http" {
+		p.httpRoutes, err = parseRouteMap(config.HTTPMap)
+		if err != nil {
+			return nil, fmt.Errorf("HTTP map: %w", err)
+		}
+		if config.HTTPDefault != "" {
+			if err := validateBackend(config.HTTPDefault); err != nil {
+				return nil, fmt.Errorf("HTTP default: %w", err)
+			}
+		}
+	}
+	return p, nil
+}
+
+// Start starts the unit and proxies the activated sockets to it. It blocks
+// until the proxy is stopped, either by Stop or by the inactivity timeout,
+// and stops the unit before returning. Everything it set up, like the sockets,
+// the metrics server and the bus connection, is closed by then, also when it
+// fails. Even then, it returns ErrBackendUnreachable if the backend never
+// became reachable.
+func (p *Proxy) Start() error {
+	if !p.config.NoUnit {
+		// tests set their own unit manager before
+		if p.unitCtrl == nil {
+			// a dry run doesn't even connect to D-Bus, it only logs what it would call
+			var unitCtrl unitManager = newDryRunUnits(p.units, p.config.StartMode, p.config.StopMode, p.log)
+			if !p.config.DryRun {
+				ctrl, err := connectUnitController(p.units, p.config.User, p.config.DBusAddress, p.log)
+				if err != nil {
+					return err
+				}
+				ctrl.startMode = p.config.StartMode
+				ctrl.stopMode = p.config.StopMode
+				ctrl.jobTimeout = p.config.BackendTimeout
+				unitCtrl = ctrl
+			}
+			p.unitCtrl = unitCtrl
+		}
+		defer p.unitCtrl.Close()
+
+		if err := p.unitCtrl.checkUnitsExist(); err != nil {
+			return err
+		}
+	}
+
+	var activator *activatorLock
+	var err error
+	if p.config.LockDir != "" && !p.config.NoUnit {
+		activator, err = registerActivator(p.config.LockDir, p.units)
+		if err != nil {
+			return err
+		}
+		// stopUnit releases it, but not on the way out after an error
+		defer activator.unregister()
+	}
+
+	if p.config.AuditLog != "" {
+		p.auditLog, err = openAuditLog(p.config.AuditLog)
+		if err != nil {
+			return err
+		}
+		defer p.auditLog.Close()
+	}
+
+	if p.config.MetricsAddr != "" {
+		stopMetrics, err := p.startMetricsServer(p.config.MetricsAddr)
+		if err != nil {
+			return err
+		}
+		defer stopMetrics()
+	}
+
+	if p.config.ControlSocket != "" {
+		stopControl, err := p.startControlSocket(p.config.ControlSocket)
+		if err != nil {
+			return err
+		}
+		defer stopControl()
+	}
+
+	// first, connect to systemd for starting the unit, unless that waits for the first client
+	if !p.config.LazyStart {
+		if err := p.activateUnit("startup"); err != nil {
+			return err
+		}
+	}
+
+	if p.config.HealthInterval > 0 {
+		go p.checkBackendHealth(p.config.HealthInterval)
+	}
+
+	// then take over the socket from systemd
+	switch p.config.Mode {
+	case "tcp", "http":
+		err = p.startTCPProxy()
+	case "udp":
+		err = p.startUDPProxy()
+	}
+	if err != nil {
+		return err
+	}
+	if p.startErr != nil {
+		return p.startErr
+	}
+
+	// the proxy only returns without shutdown if the socket failed, leave the unit alone then
+	select {
+	case <-p.shutdown:
+		if p.stopReason == stopBackendTimeout {
+			if p.config.BackendTimeoutAction == "stop-unit" {
+				p.stopUnit(activator)
+			} else {
+				p.log.Info("leaving unit running", "unit", p.config.Unit)
+			}
+			return fmt.Errorf("%w within %v", ErrBackendUnreachable, p.config.BackendTimeout)
+		}
+		p.stopUnit(activator)
+	default:
+	}
+
+	if atomic.LoadInt32(&p.backendReached) == 0 && atomic.LoadInt32(&p.backendGaveUp) == 1 {
+		return fmt.Errorf("%w within %v", ErrBackendUnreachable, p.config.BackendTimeout)
+	}
+	return nil
+}
+
+// stopBackendTimeout is the stop reason of the exit-error and stop-unit backend timeout actions.
+const stopBackendTimeout = "backend timeout"
+
+// activateUnit starts the unit and waits until systemd considers it up. The
+// trigger is the client that caused the start, if any.
+func (p *Proxy) activateUnit(trigger string) error {
+	if !p.config.NoUnit {
+		if err := p.startUnits(trigger); err != nil {
+			return err
+		}
+	}
+
+	if p.config.MaxLifetime != 0 {
+		go p.terminateAfterLifetime()
+	}
+
+	// don't bother the backend before systemd considers it up
+	if !p.config.NoUnit {
+		if err := p.unitCtrl.waitUntilActive(p.config.BackendTimeout); err != nil {
+			p.log.Warn("unit did not become active", "unit", p.config.Unit, "err", err)
+		}
+	}
+
+	// some backends accept connections before they can serve them, meanwhile
+	// new clients wait in the listen queue as nothing accepts them
+	if probes := p.config.Warmup; probes > 0 || p.config.PauseAccept {
+		if err := p.warmUp(max(probes, 1)); err != nil {
+			p.log.Warn("backend did not warm up", "err", err)
+		}
+	}
+
+	if p.pool != nil {
+		go p.fillPool()
+	}
+
+	// the inactivity timeout counts from when the unit is up, time waiting for
+	// the first client of a lazy start or for the unit to come up doesn't count
+	if p.config.Timeout != 0 {
+		poke(&p.lastActivity)
+		go p.terminateWithoutActivity()
+		if p.config.MinBytesPerInterval > 0 {
+			go p.terminateWithoutThroughput()
+		}
+	}
+	return nil
+}
+
+// startUnits starts the units that aren't active yet and remembers which ones
+// the proxy started itself.
+func (p *Proxy) startUnits(trigger string) error {
+	return p.runStart(trigger, p.unitCtrl.startSystemdUnit, true)
+}
+
+// restartUnits restarts all units, even active ones, which a backend that hung
+// but didn't crash still is. Units that were active before the proxy started
+// them are still not considered started by the proxy.
+func (p *Proxy) restartUnits(trigger string) error {
+	return p.runStart(trigger, p.unitCtrl.restartSystemdUnit, false)
+}
+
+// runStart starts units with start, accounting and auditing the units it
+// started, and with claim remembers them as started by the proxy.
+func (p *Proxy) runStart(trigger string, start func() ([]string, error), claim bool) error {
+	begin := time.Now()
+	started, err := start()
+	if len(started) > 0 {
+		atomic.AddInt64(&p.metrics.activations, 1)
+		// an eager start is done before the first client is accepted, so no client waits for it
+		if trigger != "startup" {
+			p.coldStarted()
+		}
+	}
+	if len(started) > 0 || err != nil {
+		p.audit(auditEvent{Event: "start", Units: started, Trigger: trigger, Duration: time.Since(begin).Seconds(), Error: errorString(err)})
+	}
+
+	p.unitsMu.Lock()
+	defer p.unitsMu.Unlock()
+	if p.startedUnits == nil {
+		p.startedUnits = map[string]bool{}
+	}
+	if claim {
+		for _, unit := range started {
+			p.startedUnits[unit] = true
+		}
+	}
+	if len(started) > 0 {
+		p.lastStart = begin
+	}
+	return err
+}
+
+// unitsToStop returns the units to stop once idle, with StopOnlyIfStarted only
+// those the proxy started itself.
+func (p *Proxy) unitsToStop() []string {
+	if !p.config.StopOnlyIfStarted {
+		return p.units
+	}
+
+	p.unitsMu.Lock()
+	defer p.unitsMu.Unlock()
+	var units []string
+	for _, unit := range p.units {
+		if p.startedUnits[unit] {
+			units = append(units, unit)
+		}
+	}
+	return units
+}
+
+// lazyStart activates the unit on the first call with lazy start. If that
+// fails, the proxy is stopped and Start returns the error.
+func (p *Proxy) lazyStart(client string) error {
+	if !p.config.LazyStart {
+		return nil
+	}
+	p.startOnce.Do(func() {
+		if err := p.activateUnit(client); err != nil {
+			p.startErr = err
+			p.stopBecause("start failed")
+		}
+	})
+	return p.startErr
+}
+
+// stopUnit stops the units, unless that is disabled, leaving those other
+// activators still use running. The proxy is going away anyways, so a failing stop is only logged.
+func (p *Proxy) stopUnit(activator *activatorLock) {
+	if p.config.NoUnit {
+		return
+	}
+	if p.config.NoStop {
+		p.log.Info("leaving unit running", "unit", p.config.Unit)
+		return
+	}
+	var inUse []string
+	if activator != nil {
+		var err error
+		inUse, err = activator.release()
+		if err != nil {
+			p.log.Error("checking for other activators failed, leaving unit running", "unit", p.config.Unit, "err", err)
+			return
+		}
+	}
+
+	units := p.unitsToStop()
+	if len(units) == 0 {
+		p.log.Info("unit was running before the proxy started it, leaving it running", "unit", p.config.Unit)
+		return
+	}
+	if len(inUse) > 0 {
+		p.log.Info("units still used by other activators, leaving them running", "units", inUse)
+		var unused []string
+		for _, unit := range units {
+			if !slices.Contains(inUse, unit) {
+				unused = append(unused, unit)
+			}
+		}
+		if len(unused) == 0 {
+			return
+		}
+		units = unused
+	}
+
+	// give the unit a chance to e.g. persist its state before it is stopped
+	if p.preStopSignal != 0 {
+		if err := p.unitCtrl.killSystemdUnit(p.preStopSignal, units); err != nil {
+			p.log.Warn("sending pre-stop signal failed", "unit", p.config.Unit, "err", err)
+		} else {
+			time.Sleep(p.config.PreStopGrace)
+		}
+	}
+
+	begin := time.Now()
+	err := p.unitCtrl.stopSystemdUnit(units)
+	if err != nil {
+		p.log.Error("stopping unit failed", "unit", p.config.Unit, "err", err)
+	}
+
+	// units already active before have no known uptime
+	var uptime time.Duration
+	p.unitsMu.Lock()
+	if !p.lastStart.IsZero() {
+		uptime = begin.Sub(p.lastStart)
+	}
+	p.unitsMu.Unlock()
+	p.audit(auditEvent{Event: "stop", Units: units, Reason: p.stopReason, Duration: time.Since(begin).Seconds(), Uptime: uptime.Seconds(), Error: errorString(err)})
+}
+
+// Stop makes Start stop accepting connections, drain the open ones and stop
+// the unit. It is safe to be called more than once.
+func (p *Proxy) Stop() {
+	p.stopBecause("stopped")
+}
+
+// stopBecause stops the proxy like Stop, recording reason for the audit log.
+func (p *Proxy) stopBecause(reason string) {
+	p.shutdownOnce.Do(func() {
+		p.stopReason = reason
+		close(p.shutdown)
+	})
+}
+
+// errorString returns the message of err, or an empty string if it is nil.
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// terminateAfterLifetime stops the proxy once the unit ran for the configured
+// maximum lifetime, independent of the inactivity timeout.
+func (p *Proxy) terminateAfterLifetime() {
+	select {
+	case <-time.After(p.config.MaxLifetime):
+		p.log.Info("maximum lifetime reached", "max_lifetime", p.config.MaxLifetime)
+		p.stopBecause("max lifetime")
+	case <-p.shutdown:
+	}
+}
+
+// terminateWithoutActivity stops the proxy once there was no activity for the
+// configured timeout, but not before the minimum lifetime passed. It only wakes
+// up when the timeout may have passed, so reporting activity costs no more than
+// storing its time.
+func (p *Proxy) terminateWithoutActivity() {
+	started := time.Now()
+	for {
+		wait := p.config.Timeout - time.Since(time.Unix(0, atomic.LoadInt64(&p.lastActivity)))
+		if remaining := p.config.MinLifetime - time.Since(started); remaining > wait {
+			wait = remaining
+		}
+		if wait <= 0 {
+			// quiet connections are still connections, wait until the last one is
+			// closed, which counts as activity
+			if atomic.LoadInt64(&p.activeConnections) == 0 {
+				p.log.Info("inactivity timeout reached", "timeout", p.config.Timeout)
+				p.stopBecause("idle timeout")
+				return
+			}
+			wait = p.config.Timeout
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-p.shutdown:
+			return
+		}
+	}
+}
+
+// terminateWithoutThroughput stops the proxy once fewer than the minimum bytes
+// were proxied in either direction within an inactivity timeout, so a trickle
+// of keepalives doesn't keep the unit running. Like terminateWithoutActivity,
+// it waits for the minimum lifetime first.
+func (p *Proxy) terminateWithoutThroughput() {
+	started := time.Now()
+	ticker := time.NewTicker(p.config.Timeout)
+	defer ticker.Stop()
+
+	last := p.proxiedBytes()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.shutdown:
+			return
+		}
+
+		total := p.proxiedBytes()
+		proxied := total - last
+		last = total
+		if proxied < p.config.MinBytesPerInterval && time.Since(started) >= p.config.MinLifetime {
+			p.log.Info("throughput below minimum", "bytes", proxied, "min_bytes", p.config.MinBytesPerInterval, "interval", p.config.Timeout, "active_connections", atomic.LoadInt64(&p.activeConnections))
+			p.stopBecause("low throughput")
+			return
+		}
+	}
+}
+
+// proxiedBytes returns the number of bytes proxied so far in both directions.
+func (p *Proxy) proxiedBytes() int64 {
+	return atomic.LoadInt64(&p.metrics.bytesIn) + atomic.LoadInt64(&p.metrics.bytesOut)
+}
+
+// poke records activity now.
+func poke(lastActivity *int64) {
+	atomic.StoreInt64(lastActivity, time.Now().UnixNano())
+}
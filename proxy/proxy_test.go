@@ -0,0 +1,367 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const fakeUnit = "fake.service"
+
+// fakeUnits stands in for systemd: starting the unit makes an echo backend
+// listen on backend after startDelay, stopping it closes the listener again.
+type fakeUnits struct {
+	t          *testing.T
+	backend    string
+	startDelay time.Duration
+
+	mu       sync.Mutex
+	active   bool
+	starts   int
+	stops    int
+	listener net.Listener
+	stopped  chan struct{} // closed on the first stop
+}
+
+func newFakeUnits(t *testing.T, startDelay time.Duration) *fakeUnits {
+	f := &fakeUnits{t: t, backend: freeAddr(t), startDelay: startDelay, stopped: make(chan struct{})}
+	t.Cleanup(func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.listener != nil {
+			f.listener.Close()
+		}
+	})
+	return f
+}
+
+func (f *fakeUnits) startSystemdUnit() ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.active {
+		return nil, nil
+	}
+	f.start()
+	return []string{fakeUnit}, nil
+}
+
+func (f *fakeUnits) restartSystemdUnit() ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.listener != nil {
+		f.listener.Close()
+		f.listener = nil
+	}
+	f.start()
+	return []string{fakeUnit}, nil
+}
+
+// start activates the unit, its backend only listens after startDelay.
+func (f *fakeUnits) start() {
+	f.active = true
+	f.starts++
+	starts := f.starts
+	time.AfterFunc(f.startDelay, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if !f.active || f.starts != starts {
+			return
+		}
+		l, err := net.Listen("tcp", f.backend)
+		if err != nil {
+			f.t.Errorf("fake backend can't listen: %v", err)
+			return
+		}
+		f.listener = l
+		go serveEcho(l)
+	})
+}
+
+func (f *fakeUnits) stopSystemdUnit(units []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.listener != nil {
+		f.listener.Close()
+		f.listener = nil
+	}
+	f.active = false
+	f.stops++
+	if f.stops == 1 {
+		close(f.stopped)
+	}
+	return nil
+}
+
+func (f *fakeUnits) killSystemdUnit(signal int32, units []string) error { return nil }
+
+func (f *fakeUnits) inactiveUnit() (string, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.active {
+		return fakeUnit, "inactive", nil
+	}
+	return "", "", nil
+}
+
+func (f *fakeUnits) waitUntilActive(timeout time.Duration) error { return nil }
+func (f *fakeUnits) checkUnitsExist() error                      { return nil }
+func (f *fakeUnits) Close() error                                { return nil }
+
+// counts returns how often the unit was started and stopped.
+func (f *fakeUnits) counts() (starts int, stops int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.starts, f.stops
+}
+
+func serveEcho(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(conn, conn)
+			conn.Close()
+		}()
+	}
+}
+
+// freeAddr returns a loopback address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// testConfig is a configuration proxying listen to the backend of units, with
+// short retries.
+func testConfig(listen string, units *fakeUnits) Config {
+	return Config{
+		Mode:             "tcp",
+		Unit:             fakeUnit,
+		Listen:           listen,
+		Destination:      units.backend,
+		BackendTimeout:   5 * time.Second,
+		DialTimeout:      time.Second,
+		RetryBaseDelay:   20 * time.Millisecond,
+		RetryMaxDelay:    100 * time.Millisecond,
+		DrainTimeout:     time.Second,
+		MaxConnsAction:   "wait",
+		AcceptRateAction: "wait",
+		Logger:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+}
+
+// startProxy runs Start with units as unit manager until the proxy sent
+// READY=1, and returns the channel Start's result is sent on. The proxy is
+// stopped at the end of the test.
+func startProxy(t *testing.T, config Config, units *fakeUnits) (*Proxy, <-chan error) {
+	t.Helper()
+	p, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.unitCtrl = units
+
+	notify, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(t.TempDir(), "notify"), Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer notify.Close()
+	t.Setenv("NOTIFY_SOCKET", notify.LocalAddr().String())
+
+	done := make(chan error, 1)
+	returned := make(chan struct{})
+	go func() {
+		done <- p.Start()
+		close(returned)
+	}()
+	t.Cleanup(func() {
+		p.Stop()
+		<-returned
+	})
+
+	notify.SetReadDeadline(time.Now().Add(5 * time.Second))
+	state := make([]byte, 64)
+	n, err := notify.Read(state)
+	if err != nil {
+		select {
+		case err := <-done:
+			t.Fatalf("Start() = %v before the proxy was ready", err)
+		default:
+		}
+		t.Fatalf("waiting for READY=1: %v", err)
+	}
+	if string(state[:n]) != "READY=1" {
+		t.Fatalf("proxy notified %q, want READY=1", state[:n])
+	}
+	return p, done
+}
+
+// echo sends msg through conn and checks that it comes back.
+func echo(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("reading the echo of %q: %v", msg, err)
+	}
+	if string(reply) != msg {
+		t.Fatalf("echo = %q, want %q", reply, msg)
+	}
+}
+
+func TestProxyStartsUnitOnFirstConnection(t *testing.T) {
+	units := newFakeUnits(t, 0)
+	listen := freeAddr(t)
+	config := testConfig(listen, units)
+	config.LazyStart = true
+	startProxy(t, config, units)
+
+	if starts, _ := units.counts(); starts != 0 {
+		t.Fatalf("unit started %d times before the first connection, want 0", starts)
+	}
+
+	conn, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn, "first")
+
+	second, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	echo(t, second, "second")
+
+	if starts, _ := units.counts(); starts != 1 {
+		t.Errorf("unit started %d times, want once", starts)
+	}
+}
+
+func TestProxyRetriesUntilBackendListens(t *testing.T) {
+	const startDelay = 300 * time.Millisecond
+	units := newFakeUnits(t, startDelay)
+	listen := freeAddr(t)
+	p, _ := startProxy(t, testConfig(listen, units), units)
+
+	begin := time.Now()
+	conn, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn, "hello")
+
+	if failures := atomic.LoadInt64(&p.metrics.dialFailures); failures == 0 {
+		t.Error("no dial failed while the backend was down, want retries")
+	}
+	if waited := time.Since(begin); waited > startDelay+2*time.Second {
+		t.Errorf("connection took %v to reach the backend, want about %v", waited, startDelay)
+	}
+}
+
+func TestProxyStopsUnitWhenIdle(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	units := newFakeUnits(t, 0)
+	listen := freeAddr(t)
+	config := testConfig(listen, units)
+	config.Timeout = timeout
+	_, done := startProxy(t, config, units)
+
+	conn, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, "hello")
+
+	// an open connection keeps the unit running, even if it is quiet
+	time.Sleep(3 * timeout)
+	if _, stops := units.counts(); stops != 0 {
+		t.Fatalf("unit stopped %d times with a connection open, want 0", stops)
+	}
+
+	conn.Close()
+	select {
+	case <-units.stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("unit not stopped after the inactivity timeout")
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Start() = %v, want nil after the inactivity timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start didn't return after stopping the unit")
+	}
+
+	if _, err := net.Dial("tcp", listen); err == nil {
+		t.Error("proxy still accepts connections after it stopped")
+	}
+	if starts, stops := units.counts(); starts != 1 || stops != 1 {
+		t.Errorf("unit started %d and stopped %d times, want once each", starts, stops)
+	}
+}
+
+func TestProxyClosesConnectionsAfterDrainTimeout(t *testing.T) {
+	units := newFakeUnits(t, 0)
+	listen := freeAddr(t)
+	config := testConfig(listen, units)
+	config.DrainTimeout = 200 * time.Millisecond
+	p, done := startProxy(t, config, units)
+
+	conn, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn, "hello")
+
+	p.Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start didn't return after the drain timeout")
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	// closing the backend side first may reset the client
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("read from the connection after the drain timeout = %v, want it closed", err)
+	}
+}
+
+func TestReloadKeepsPoolableBackends(t *testing.T) {
+	units := newFakeUnits(t, 0)
+	config := testConfig(freeAddr(t), units)
+	config.BackendPoolSize = 2
+	p, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.Destination = "127.0.0.1:1%P"
+	if err := p.Reload(config); err == nil {
+		t.Fatal("Reload() accepted a backend depending on the connection for a pool")
+	}
+	if backends := p.current.Load().backends; len(backends) != 1 || backends[0] != units.backend {
+		t.Errorf("backends %v after the failed reload, want %s", backends, units.backend)
+	}
+}
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// proxyProtocolV2Signature starts every PROXY protocol v2 header.
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// sendProxyProtocolHeader announces the client connection from src to dst to
+// the backend, if configured. The header must be sent before any client data.
+func (p *Proxy) sendProxyProtocolHeader(connBackend net.Conn, src net.Addr, dst net.Addr) error {
+	if p.config.ProxyProtocol == "" {
+		return nil
+	}
+
+	header, err := proxyProtocolHeader(p.config.ProxyProtocol, src, dst)
+	if err != nil {
+		return err
+	}
+	_, err = connBackend.Write(header)
+	return err
+}
+
+// proxyProtocolHeader builds a HAProxy PROXY protocol header (see
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt) of the given
+// version, announcing a connection from src to dst. Addresses other than TCP
+// ones (e.g. of Unix sockets) are sent as unknown.
+func proxyProtocolHeader(version string, src net.Addr, dst net.Addr) ([]byte, error) {
+	srcTCP, srcOk := src.(*net.TCPAddr)
+	dstTCP, dstOk := dst.(*net.TCPAddr)
+	known := srcOk && dstOk
+
+	// both addresses need the same family, so only use IPv4 if both are
+	ipv4 := known && srcTCP.IP.To4() != nil && dstTCP.IP.To4() != nil
+	var srcIP, dstIP net.IP
+	if known && ipv4 {
+		srcIP, dstIP = srcTCP.IP.To4(), dstTCP.IP.To4()
+	} else if known {
+		srcIP, dstIP = srcTCP.IP.To16(), dstTCP.IP.To16()
+	}
+
+	switch version {
+	case "v1":
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		family := "TCP6"
+		if ipv4 {
+			family = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, srcTCP.Port, dstTCP.Port)), nil
+
+	case "v2":
+		header := append([]byte{}, proxyProtocolV2Signature...)
+		if !known {
+			// LOCAL command, the receiver uses the real connection endpoints
+			return append(header, 0x20, 0x00, 0x00, 0x00), nil
+		}
+
+		family := byte(0x21) // TCP over IPv6
+		if ipv4 {
+			family = 0x11 // TCP over IPv4
+		}
+		header = append(header, 0x21, family) // version 2, PROXY command
+
+		addresses := make([]byte, 0, 2*len(srcIP)+4)
+		addresses = append(addresses, srcIP...)
+		addresses = append(addresses, dstIP...)
+		addresses = binary.BigEndian.AppendUint16(addresses, uint16(srcTCP.Port))
+		addresses = binary.BigEndian.AppendUint16(addresses, uint16(dstTCP.Port))
+
+		header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+		return append(header, addresses...), nil
+	}
+	return nil, fmt.Errorf("unknown PROXY protocol version %q, available: v1, v2", version)
+}
+
+// proxyProtocolHeaderTimeout bounds the time a client may take to send its PROXY protocol header.
+const proxyProtocolHeaderTimeout = 10 * time.Second
+
+// readProxyProtocolHeader reads and parses a PROXY protocol v1 or v2 header
+// from conn, returning the announced source and destination. Both are nil if
+// the sender didn't announce them (UNKNOWN or LOCAL). The header is consumed
+// byte-exact, so everything after it can be read from conn as usual.
+func readProxyProtocolHeader(conn net.Conn) (net.Addr, net.Addr, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	// both versions are at least as long as the v2 signature
+	start := make([]byte, len(proxyProtocolV2Signature))
+	if _, err := io.ReadFull(conn, start); err != nil {
+		return nil, nil, err
+	}
+
+	if bytes.Equal(start, proxyProtocolV2Signature) {
+		return readProxyProtocolV2(conn)
+	}
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readProxyProtocolV1(conn, start)
+	}
+	return nil, nil, errors.New("no PROXY protocol header")
+}
+
+func readProxyProtocolV1(conn net.Conn, start []byte) (net.Addr, net.Addr, error) {
+	// the line is at most 107 bytes, read byte-wise to not consume client data
+	line := start
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= 107 {
+			return nil, nil, errors.New("PROXY protocol v1 header too long")
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed PROXY protocol v1 header %q", strings.TrimSpace(string(line)))
+	}
+
+	src, err := proxyProtocolV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := proxyProtocolV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+// proxyProtocolV1Addr parses an address of a v1 header, which must be a
+// literal IP of family TCP4 or TCP6. Names are never looked up, the header
+// comes from the client.
+func proxyProtocolV1Addr(family string, ip string, port string) (*net.TCPAddr, error) {
+	addr, err := netip.ParseAddrPort(net.JoinHostPort(ip, port))
+	if err != nil {
+		return nil, fmt.Errorf("invalid address in PROXY protocol v1 header: %w", err)
+	}
+	if ip := addr.Addr(); ip.Zone() != "" || (family == "TCP4") != ip.Is4() {
+		return nil, fmt.Errorf("address %s in PROXY protocol v1 header is not %s", ip, family)
+	}
+	return net.TCPAddrFromAddrPort(addr), nil
+}
+
+func readProxyProtocolV2(conn net.Conn) (net.Addr, net.Addr, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, nil, err
+	}
+	if header[0]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol version %d", header[0]>>4)
+	}
+
+	addresses := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(conn, addresses); err != nil {
+		return nil, nil, err
+	}
+
+	// LOCAL command, e.g. health checks of the load balancer itself
+	if header[0]&0x0f == 0 {
+		return nil, nil, nil
+	}
+
+	var ipLen int
+	switch header[1] {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(addresses) < 2*ipLen+4 {
+		return nil, nil, errors.New("PROXY protocol v2 header too short")
+	}
+
+	src := &net.TCPAddr{IP: net.IP(addresses[:ipLen]), Port: int(binary.BigEndian.Uint16(addresses[2*ipLen:]))}
+	dst := &net.TCPAddr{IP: net.IP(addresses[ipLen : 2*ipLen]), Port: int(binary.BigEndian.Uint16(addresses[2*ipLen+2:]))}
+	return src, dst, nil
+}
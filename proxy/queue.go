@@ -0,0 +1,57 @@
+package proxy
+
+import "time"
+
+// enqueue parks c until the backend is reachable, or rejects it if the queue
+// is full. A parked connection is dropped once it waited the queue timeout.
+func (p *Proxy) enqueue(c pendingConn) {
+	c.deadline = c.accepted.Add(p.config.QueueTimeout)
+	c.expiry = time.AfterFunc(time.Until(c.deadline), func() {
+		p.log.Warn("connection waited too long for the backend, dropping connection", "client", c.client, "waited", time.Since(c.accepted))
+		c.conn.Close()
+		p.connectionClosed()
+	})
+
+	select {
+	case p.queue <- c:
+		p.log.Debug("connection queued until the backend is reachable", "client", c.client, "queued", len(p.queue))
+	default:
+		p.log.Warn("connection queue full, rejecting connection", "client", c.client, "queue_size", p.config.QueueSize)
+		p.dropQueued(c)
+	}
+}
+
+// dropQueued closes a queued connection, unless its expiry did already.
+func (p *Proxy) dropQueued(c pendingConn) {
+	if c.expiry.Stop() {
+		c.conn.Close()
+		p.connectionClosed()
+	}
+}
+
+// drainQueue forwards the queued connections in the order they arrived. The
+// first one waits for the backend to come up, the others follow right away
+// then. Connections whose queue timeout expired meanwhile were dropped by
+// their expiry already, and the dial of a connection only gets what is left
+// of its queue timeout.
+func (p *Proxy) drainQueue() {
+	for {
+		select {
+		case c := <-p.queue:
+			if !c.expiry.Stop() {
+				continue
+			}
+			p.forwardConnection(c, false)
+
+		case <-p.shutdown:
+			for {
+				select {
+				case c := <-p.queue:
+					p.dropQueued(c)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
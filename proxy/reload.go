@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// settings are the parts of the configuration Reload can change while the
+// proxy runs. They are replaced as a whole, so a connection sees either the
+// old or the new ones.
+type settings struct {
+	backends       []string
+	backendDown    []int32 // accessed atomically, 1 if the health check failed for the backend at the same index
+	allowPrefixes  []netip.Prefix
+	denyPrefixes   []netip.Prefix
+	retryMax       int
+	retryBaseDelay time.Duration
+	retryMaxDelay  time.Duration
+}
+
+func newSettings(config Config) (*settings, error) {
+	backends, err := parseBackends(config.Destination)
+	if err != nil {
+		return nil, err
+	}
+	allow, err := parsePrefixes(config.AllowCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("allowed clients: %w", err)
+	}
+	deny, err := parsePrefixes(config.DenyCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("denied clients: %w", err)
+	}
+	return &settings{
+		backends:       backends,
+		backendDown:    make([]int32, len(backends)),
+		allowPrefixes:  allow,
+		denyPrefixes:   deny,
+		retryMax:       config.RetryMax,
+		retryBaseDelay: config.RetryBaseDelay,
+		retryMaxDelay:  config.RetryMaxDelay,
+	}, nil
+}
+
+// Reload applies the destination, the retry settings and the allowed and
+// denied clients of config to new connections, open ones are left alone. The
+// TLS certificate is loaded again as well. All other settings, like the
+// activated sockets and the unit, need a restart. Pooled backend connections
+// are replaced if the backends changed. If config is invalid, nothing changes.
+func (p *Proxy) Reload(config Config) error {
+	s, err := newSettings(config)
+	if err != nil {
+		return err
+	}
+	if p.pool != nil {
+		if err := poolable(s.backends); err != nil {
+			return err
+		}
+	}
+	if p.certs != nil {
+		if err := p.certs.reload(); err != nil {
+			return fmt.Errorf("loading TLS certificate: %w", err)
+		}
+	}
+	old := p.current.Swap(s)
+	if p.pool != nil && !slices.Equal(old.backends, s.backends) {
+		p.emptyPool()
+	}
+	p.log.Info("configuration reloaded", "destination", config.Destination)
+	return nil
+}
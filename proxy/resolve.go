@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// resolver looks up all addresses of backend hostnames, caching them for ttl.
+type resolver struct {
+	ttl time.Duration // 0 to look up on every use
+
+	mu    sync.Mutex
+	cache map[string]resolved
+}
+
+type resolved struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// lookup returns the A and AAAA records of host.
+func (r *resolver) lookup(host string, timeout time.Duration) ([]net.IP, error) {
+	r.mu.Lock()
+	entry, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.ips, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+
+	if r.ttl > 0 {
+		r.mu.Lock()
+		if r.cache == nil {
+			r.cache = make(map[string]resolved)
+		}
+		r.cache[host] = resolved{ips, time.Now().Add(r.ttl)}
+		r.mu.Unlock()
+	}
+	return ips, nil
+}
+
+// forget drops the cached addresses of host, e.g. because none of them answered.
+func (r *resolver) forget(host string) {
+	r.mu.Lock()
+	delete(r.cache, host)
+	r.mu.Unlock()
+}
+
+// dialer returns a dialer for backend connections on network, binding them to
+// the local address and interface if configured.
+func (p *Proxy) dialer(network string) *net.Dialer {
+	dialer := &net.Dialer{Timeout: p.config.DialTimeout}
+	if network != "tcp" && network != "udp" {
+		return dialer
+	}
+	dialer.Control = p.bindInterface
+	if p.localAddr.IsValid() {
+		ip, zone := p.localAddr.AsSlice(), p.localAddr.Zone()
+		if network == "tcp" {
+			dialer.LocalAddr = &net.TCPAddr{IP: ip, Zone: zone}
+		} else {
+			dialer.LocalAddr = &net.UDPAddr{IP: ip, Zone: zone}
+		}
+	}
+	return dialer
+}
+
+// dialResolved connects to address, trying every address its host resolves to
+// in turn until one accepts the connection.
+func (p *Proxy) dialResolved(network string, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if network != "tcp" || err != nil {
+		return p.dialer(network).Dial(network, address)
+	}
+	// IP addresses need no lookup, including IPv6 ones with a zone
+	if _, err := netip.ParseAddr(host); err == nil {
+		return p.dialer(network).Dial(network, address)
+	}
+
+	ips, err := p.resolver.lookup(host, p.config.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if p.config.HEDelay > 0 && len(ips) > 1 {
+		conn, err := p.dialHappyEyeballs(network, host, port, ips)
+		if err != nil {
+			p.resolver.forget(host)
+		}
+		return conn, err
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = p.dialer(network).Dial(network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		p.log.Debug("backend address failed", "host", host, "ip", ip, "err", err)
+	}
+	// the records may have changed meanwhile
+	p.resolver.forget(host)
+	return nil, err
+}
+
+// dialHappyEyeballs races connections to the addresses of host as described in
+// RFC 8305: they are tried alternating between IPv6 and IPv4, each getting a
+// head start of HEDelay before the next one is tried in parallel, or less if
+// it fails earlier. The first connection established wins.
+func (p *Proxy) dialHappyEyeballs(network string, host string, port string, ips []net.IP) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type attempt struct {
+		conn net.Conn
+		ip   net.IP
+		err  error
+	}
+	attempts := make(chan attempt, len(ips))
+	ips = interleaveFamilies(ips)
+	next, pending := 0, 0
+	var headStart <-chan time.Time
+	startNext := func() {
+		if next == len(ips) {
+			headStart = nil
+			return
+		}
+		ip := ips[next]
+		next++
+		pending++
+		go func() {
+			conn, err := p.dialer(network).DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			attempts <- attempt{conn, ip, err}
+		}()
+		headStart = time.After(p.config.HEDelay)
+	}
+
+	startNext()
+	var err error
+	for pending > 0 {
+		select {
+		case a := <-attempts:
+			pending--
+			if a.err == nil {
+				// the losers are canceled, close those that connected anyway
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-attempts; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				p.log.Debug("backend address chosen", "host", host, "ip", a.ip, "family", ipFamily(a.ip))
+				return a.conn, nil
+			}
+			err = a.err
+			p.log.Debug("backend address failed", "host", host, "ip", a.ip, "err", a.err)
+			startNext()
+		case <-headStart:
+			startNext()
+		}
+	}
+	return nil, err
+}
+
+// interleaveFamilies orders ips alternating between IPv6 and IPv4, starting
+// with IPv6, keeping the order within each family.
+func interleaveFamilies(ips []net.IP) []net.IP {
+	var v6, v4 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	ordered := make([]net.IP, 0, len(ips))
+	for len(v6) > 0 || len(v4) > 0 {
+		if len(v6) > 0 {
+			ordered = append(ordered, v6[0])
+			v6 = v6[1:]
+		}
+		if len(v4) > 0 {
+			ordered = append(ordered, v4[0])
+			v4 = v4[1:]
+		}
+	}
+	return ordered
+}
+
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// A route expression picks the backend of each connection with the language
+// of github.com/expr-lang/expr, e.g.
+//
+//	inCIDR(clientIP, "10.0.0.0/8") ? "127.0.0.1:8081" : hour < 6 ? "" : "127.0.0.1:8082"
+//
+// It sees the fields of routeEnv and inCIDR besides expr's own operators and
+// functions, and must result in a string. An empty result leaves the
+// connection to the usual routing.
+
+// routeEnv holds what a route expression knows about a connection.
+type routeEnv struct {
+	ClientIP   string `expr:"clientIP"` // empty for clients without IP address, e.g. on Unix sockets
+	ClientPort int    `expr:"clientPort"`
+	ServerName string `expr:"serverName"` // server name or host the connection was routed by
+	LocalPort  int    `expr:"localPort"`  // port of the activated socket
+	Hour       int    `expr:"hour"`
+	Weekday    int    `expr:"weekday"` // 0 is Sunday
+}
+
+// routeExpr is a compiled route expression.
+type routeExpr struct {
+	program *vm.Program
+}
+
+func compileRouteExpr(source string) (*routeExpr, error) {
+	program, err := expr.Compile(source, expr.Env(routeEnv{}), expr.AsKind(reflect.String), inCIDR)
+	if err != nil {
+		return nil, err
+	}
+	return &routeExpr{program}, nil
+}
+
+// inCIDR is the expression function inCIDR(ip, cidrs), true if ip is in one
+// of the comma separated cidrs.
+var inCIDR = expr.Function("inCIDR", func(params ...any) (any, error) {
+	prefixes, err := parsePrefixes(params[1].(string))
+	if err != nil {
+		return nil, err
+	}
+	ip, err := netip.ParseAddr(params[0].(string))
+	if err != nil {
+		return false, nil
+	}
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip.Unmap()) {
+			return true, nil
+		}
+	}
+	return false, nil
+}, new(func(string, string) bool))
+
+func (r *routeExpr) route(env routeEnv) (string, error) {
+	result, err := expr.Run(r.program, env)
+	if err != nil {
+		return "", err
+	}
+	backend, ok := result.(string)
+	if !ok {
+		return "", fmt.Errorf("expression gave %T, not a backend address", result)
+	}
+	return backend, nil
+}
+
+// errBadRoute is returned by exprRoute if the expression resulted in no valid
+// backend address, e.g. because a variable it concatenated was empty.
+type errBadRoute struct{ err error }
+
+func (e errBadRoute) Error() string { return "route expression: " + e.err.Error() }
+func (e errBadRoute) Unwrap() error { return e.err }
+
+// exprRoute evaluates the route expression for a connection from src on the
+// socket at local, falling back to route if it results in an empty string.
+func (p *Proxy) exprRoute(route string, src net.Addr, local net.Addr, host string) (string, error) {
+	now := time.Now()
+	env := routeEnv{ServerName: host, Hour: now.Hour(), Weekday: int(now.Weekday())}
+	if addrPort, err := netip.ParseAddrPort(src.String()); err == nil {
+		env.ClientIP = addrPort.Addr().Unmap().String()
+		env.ClientPort = int(addrPort.Port())
+	}
+	if _, port, err := net.SplitHostPort(local.String()); err == nil {
+		env.LocalPort, _ = strconv.Atoi(port)
+	}
+
+	backend, err := p.routeExpr.route(env)
+	if err != nil {
+		return "", errBadRoute{err}
+	}
+	p.log.Debug("routing by expression", "client", src, "backend", backend)
+	if backend != "" {
+		if err := validateBackend(backend); err != nil {
+			return "", errBadRoute{err}
+		}
+		return backend, nil
+	}
+	if route == "" && p.config.Mode == "http" {
+		return "", errNoRoute(host)
+	}
+	return route, nil
+}
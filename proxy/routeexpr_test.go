@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+)
+
+func TestExprRoute(t *testing.T) {
+	const source = `inCIDR(clientIP, "10.0.0.0/8") ? "10.0.0.1:" + string(localPort) :
+		serverName endsWith ".internal" ? "unix:/run/" + serverName + ".sock" :
+		clientIP == "192.0.2.9" ? clientIP :
+		clientIP == "192.0.2.10" && inCIDR(clientIP, serverName) ? "127.0.0.1:1" :
+		""`
+	compiled, err := compileRouteExpr(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}
+	tests := []struct {
+		name  string
+		mode  string
+		route string // routed by the usual means before
+		src   net.Addr
+		host  string
+
+		want    string
+		wantErr error // matched with errors.As
+	}{
+		{
+			name: "client address",
+			src:  &net.TCPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 5555},
+			want: "10.0.0.1:8080",
+		},
+		{
+			name: "IPv4-mapped client address",
+			src:  &net.TCPAddr{IP: net.ParseIP("::ffff:10.1.2.3"), Port: 5555},
+			want: "10.0.0.1:8080",
+		},
+		{
+			name: "server name",
+			src:  &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5555},
+			host: "db.internal",
+			want: "unix:/run/db.internal.sock",
+		},
+		{
+			name: "client without IP address",
+			src:  &net.UnixAddr{Name: "@", Net: "unix"},
+			want: "",
+		},
+		{
+			name:  "empty result keeps the usual route",
+			src:   &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5555},
+			route: "127.0.0.1:9000",
+			want:  "127.0.0.1:9000",
+		},
+		{
+			name:    "empty result without route in http mode",
+			mode:    "http",
+			src:     &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5555},
+			host:    "unknown.example.com",
+			wantErr: errNoRoute(""),
+		},
+		{
+			name:    "invalid backend address",
+			src:     &net.TCPAddr{IP: net.IPv4(192, 0, 2, 9), Port: 5555},
+			wantErr: errBadRoute{},
+		},
+		{
+			name:    "failing evaluation",
+			src:     &net.TCPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 5555},
+			host:    "not a CIDR",
+			wantErr: errBadRoute{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mode := tt.mode
+			if mode == "" {
+				mode = "tcp"
+			}
+			p := &Proxy{config: Config{Mode: mode}, log: slog.New(slog.NewTextHandler(io.Discard, nil)), routeExpr: compiled}
+
+			got, err := p.exprRoute(tt.route, tt.src, local, tt.host)
+			switch want := tt.wantErr.(type) {
+			case nil:
+				if err != nil || got != tt.want {
+					t.Errorf("exprRoute() = %q, %v, want %q", got, err, tt.want)
+				}
+			case errNoRoute:
+				if !errors.As(err, &want) {
+					t.Errorf("exprRoute() = %q, %v, want errNoRoute", got, err)
+				}
+			case errBadRoute:
+				if !errors.As(err, &want) {
+					t.Errorf("exprRoute() = %q, %v, want errBadRoute", got, err)
+				}
+			}
+		})
+	}
+}
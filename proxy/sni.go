@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// clientHelloTimeout bounds the time a client may take to send its TLS ClientHello.
+const clientHelloTimeout = 10 * time.Second
+
+// errClientHelloRead aborts the handshake once the ClientHello was read.
+var errClientHelloRead = errors.New("client hello read")
+
+// parseRouteMap parses a comma-separated list of name=backend pairs, e.g. for
+// routing by server name. Names are matched case-insensitively.
+func parseRouteMap(s string) (map[string]string, error) {
+	routes := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, backend, ok := strings.Cut(pair, "=")
+		name, backend = strings.TrimSpace(name), strings.TrimSpace(backend)
+		if !ok || name == "" || backend == "" {
+			return nil, fmt.Errorf("invalid route %q, expected name=backend", pair)
+		}
+		if err := validateBackend(backend); err != nil {
+			return nil, err
+		}
+		routes[strings.ToLower(name)] = backend
+	}
+	return routes, nil
+}
+
+// peekedConn is what the TLS server sees of a connection while peeking the
+// ClientHello: it can only read, and only from the recording reader.
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c peekedConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c peekedConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// peekServerName reads the TLS ClientHello from conn without answering it and
+// returns the requested server name along with all bytes read, which still
+// have to be passed on to the backend.
+func peekServerName(conn net.Conn) (string, []byte, error) {
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var peeked bytes.Buffer
+	var serverName string
+	config := &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	}
+
+	err := tls.Server(peekedConn{conn, io.TeeReader(conn, &peeked)}, config).Handshake()
+	if !errors.Is(err, errClientHelloRead) {
+		return "", nil, fmt.Errorf("reading TLS client hello: %w", err)
+	}
+	return strings.ToLower(serverName), peeked.Bytes(), nil
+}
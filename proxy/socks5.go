@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	netproxy "golang.org/x/net/proxy"
+)
+
+// parseSOCKS5 parses a SOCKS5 server given as [user:password@]host:port,
+// optionally prefixed with socks5://, into its address and credentials.
+func parseSOCKS5(s string) (string, *netproxy.Auth, error) {
+	u, err := url.Parse("socks5://" + strings.TrimPrefix(s, "socks5://"))
+	if err != nil {
+		return "", nil, err
+	}
+	if u.Port() == "" {
+		return "", nil, fmt.Errorf("SOCKS5 proxy %q needs a port", u.Host)
+	}
+	if u.User == nil {
+		return u.Host, nil, nil
+	}
+	auth := &netproxy.Auth{User: u.User.Username()}
+	auth.Password, _ = u.User.Password()
+	return u.Host, auth, nil
+}
+
+// socks5Forward connects to the SOCKS5 proxy itself like to any backend, so
+// the local address and interface of backend connections apply to it.
+type socks5Forward struct{ p *Proxy }
+
+func (f socks5Forward) Dial(network string, address string) (net.Conn, error) {
+	return f.p.dialResolved(network, address)
+}
+
+// newSOCKS5 returns a dialer connecting through the SOCKS5 proxy given as
+// [user:password@]host:port.
+func (p *Proxy) newSOCKS5(s string) (netproxy.ContextDialer, error) {
+	address, auth, err := parseSOCKS5(s)
+	if err != nil {
+		return nil, err
+	}
+	dialer, err := netproxy.SOCKS5("tcp", address, auth, socks5Forward{p})
+	if err != nil {
+		return nil, err
+	}
+	return dialer.(netproxy.ContextDialer), nil
+}
+
+// dialSOCKS5 connects to address through the SOCKS5 proxy, within the dial
+// timeout. Hostnames are resolved by the proxy, only its own address is
+// resolved locally.
+func (p *Proxy) dialSOCKS5(address string) (net.Conn, error) {
+	ctx := context.Background()
+	if p.config.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.config.DialTimeout)
+		defer cancel()
+	}
+	return p.socks5.DialContext(ctx, "tcp", address)
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestDialSOCKS5 connects to a backend by hostname through a SOCKS5 server
+// asking for username and password, which answers with the bytes of a
+// successful CONNECT once it got the request it expects.
+func TestDialSOCKS5(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	want := [][]byte{
+		{5, 2, 0, 2}, // no authentication or username and password
+		append(append([]byte{1, 5}, "alice\x06"...), "secret"...),
+		append(append([]byte{5, 1, 0, 3, 15}, "backend.example"...), 0x1f, 0x90),
+	}
+	replies := [][]byte{
+		{5, 2},
+		{1, 0},
+		{5, 0, 0, 1, 10, 0, 0, 1, 0x1f, 0x90},
+	}
+	served := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			served <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		for i := range want {
+			got := make([]byte, len(want[i]))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				served <- err
+				return
+			}
+			if !bytes.Equal(got, want[i]) {
+				served <- fmt.Errorf("got %v, want %v", got, want[i])
+				return
+			}
+			conn.Write(replies[i])
+		}
+		// proxy the connection to an echo backend
+		served <- nil
+		io.Copy(conn, conn)
+	}()
+
+	p := &Proxy{config: Config{DialTimeout: 5 * time.Second}}
+	p.socks5, err = p.newSOCKS5("socks5://alice:secret@" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := p.dialAddress("tcp", "backend.example:8080")
+	if err != nil {
+		t.Fatalf("dialAddress() through SOCKS5 = %v, server: %v", err, <-served)
+	}
+	defer conn.Close()
+	if err := <-served; err != nil {
+		t.Fatalf("SOCKS5 server: %v", err)
+	}
+	echo(t, conn, "payload")
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd, see sd_listen_fds(3).
+const listenFdsStart = 3
+
+// activatedFiles returns the sockets passed by systemd, as announced in LISTEN_FDS.
+// With a non-empty fdName, only the sockets with that FileDescriptorName= are returned.
+// Like sd_listen_fds(3) with unset_environment, it removes the LISTEN_*
+// variables and marks the sockets close-on-exec, so commands run by the proxy
+// neither inherit them nor take them for theirs.
+func activatedFiles(fdName string) ([]*os.File, error) {
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil || n < 1 {
+		return nil, errors.New("no sockets passed by systemd (LISTEN_FDS unset or invalid)")
+	}
+
+	var files []*os.File
+	for i := 0; i < n; i++ {
+		name := "systemd-socket"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		if fdName != "" && name != fdName {
+			continue
+		}
+		closeOnExec(listenFdsStart + i)
+		files = append(files, os.NewFile(uintptr(listenFdsStart+i), name))
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no socket named %q passed by systemd, available: %s", fdName, strings.Join(names, ", "))
+	}
+	return files, nil
+}
+
+// sdNotify sends a state notification like "READY=1" to systemd, see
+// sd_notify(3). Without NOTIFY_SOCKET it does nothing.
+func sdNotify(state string) error {
+	socketAddr := os.Getenv("NOTIFY_SOCKET")
+	if socketAddr == "" {
+		return nil
+	}
+	// abstract sockets are announced with a leading @
+	if socketAddr[0] == '@' {
+		socketAddr = "\x00" + socketAddr[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketAddr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// notifyReady tells systemd the proxy is up and, if a watchdog is configured
+// via WATCHDOG_USEC, keeps pinging it at half the watchdog interval.
+func notifyReady(logger *slog.Logger) {
+	if err := sdNotify("READY=1"); err != nil {
+		logger.Warn("notifying systemd failed", "err", err)
+	}
+
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	go func() {
+		for range time.Tick(time.Duration(usec) * time.Microsecond / 2) {
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				logger.Warn("pinging systemd watchdog failed", "err", err)
+			}
+		}
+	}()
+}
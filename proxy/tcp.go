@@ -0,0 +1,763 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// activityReader records activity whenever data was read from r,
+// adds the number of bytes read to counter and calls touch, if set.
+type activityReader struct {
+	r            io.Reader
+	lastActivity *int64
+	counter      *int64
+	touch        func()
+}
+
+func (a activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		atomic.AddInt64(a.counter, int64(n))
+		poke(a.lastActivity)
+		if a.touch != nil {
+			a.touch()
+		}
+	}
+	return n, err
+}
+
+// writerOnly hides an io.ReaderFrom implementation of the wrapped writer, so
+// io.CopyBuffer actually uses the buffer it is given. Its errors are marked as
+// writeError, to tell them from those of reading.
+type writerOnly struct {
+	io.Writer
+}
+
+func (w writerOnly) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err != nil {
+		err = writeError{err}
+	}
+	return n, err
+}
+
+// writeError is an error of writing to the destination of a copy, as opposed
+// to reading from its source.
+type writeError struct {
+	err error
+}
+
+func (e writeError) Error() string { return e.err.Error() }
+func (e writeError) Unwrap() error { return e.err }
+
+// connError is an error of a proxied connection, attributed to the side that broke.
+type connError struct {
+	side string   // client or backend
+	addr net.Addr // remote address of that side
+	err  error
+}
+
+func (e *connError) Error() string { return fmt.Sprintf("%s %s: %v", e.side, e.addr, e.err) }
+func (e *connError) Unwrap() error { return e.err }
+
+// blame attributes an error of copying from one side to the other to the side
+// it happened on: the destination for write errors, the source otherwise.
+func blame(err error, from net.Conn, to net.Conn, fromSide string, toSide string) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	var writeErr writeError
+	if errors.As(err, &writeErr) {
+		return &connError{toSide, to.RemoteAddr(), writeErr.err}
+	}
+	return &connError{fromSide, from.RemoteAddr(), err}
+}
+
+// idleDeadlines pushes the read deadlines of both sides of a connection on
+// every transfer, so reads time out once neither side sent anything for the
+// connection idle timeout, or one side didn't for its own idle timeout.
+type idleDeadlines struct {
+	client  net.Conn
+	backend net.Conn
+
+	connTimeout    time.Duration
+	clientTimeout  time.Duration
+	backendTimeout time.Duration
+
+	mu          sync.Mutex
+	lastClient  time.Time // last read from the client
+	lastBackend time.Time // last read from the backend
+}
+
+// newIdleDeadlines sets the first deadlines of a connection, it returns nil
+// if no idle timeout is configured.
+func (p *Proxy) newIdleDeadlines(connOutwards net.Conn, connBackend net.Conn) *idleDeadlines {
+	if p.config.ConnIdleTimeout <= 0 && p.config.ClientIdleTimeout <= 0 && p.config.BackendIdleTimeout <= 0 {
+		return nil
+	}
+	now := time.Now()
+	d := &idleDeadlines{
+		client:         connOutwards,
+		backend:        connBackend,
+		connTimeout:    p.config.ConnIdleTimeout,
+		clientTimeout:  p.config.ClientIdleTimeout,
+		backendTimeout: p.config.BackendIdleTimeout,
+		lastClient:     now,
+		lastBackend:    now,
+	}
+	d.update(now)
+	return d
+}
+
+// touch records a read from the client or the backend.
+func (d *idleDeadlines) touch(fromClient bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if fromClient {
+		d.lastClient = now
+	} else {
+		d.lastBackend = now
+	}
+	d.update(now)
+}
+
+func (d *idleDeadlines) update(now time.Time) {
+	d.client.SetReadDeadline(d.deadline(now, d.lastClient, d.clientTimeout))
+	d.backend.SetReadDeadline(d.deadline(now, d.lastBackend, d.backendTimeout))
+}
+
+// deadline returns the earlier of the deadlines by the connection idle timeout
+// and that of a side, the zero time if neither is set.
+func (d *idleDeadlines) deadline(now time.Time, last time.Time, sideTimeout time.Duration) time.Time {
+	var deadline time.Time
+	if d.connTimeout > 0 {
+		deadline = now.Add(d.connTimeout)
+	}
+	if sideTimeout > 0 {
+		if side := last.Add(sideTimeout); deadline.IsZero() || side.Before(deadline) {
+			deadline = side
+		}
+	}
+	return deadline
+}
+
+// proxyNetworkConnections copies from into to and returns the number of bytes
+// copied, from the client to the backend if fromClient is set and the other
+// way around otherwise.
+func (p *Proxy) proxyNetworkConnections(from net.Conn, to net.Conn, fromClient bool, deadlines *idleDeadlines) (int64, error) {
+	counter := &p.metrics.bytesOut
+	if fromClient {
+		counter = &p.metrics.bytesIn
+	}
+	var touch func()
+	if deadlines != nil {
+		touch = func() { deadlines.touch(fromClient) }
+	}
+
+	// reuse buffers, with many short connections allocating them adds up
+	buffer := p.buffers.Get().(*[]byte)
+	defer p.buffers.Put(buffer)
+	n, err := io.CopyBuffer(writerOnly{to}, activityReader{from, &p.lastActivity, counter, touch}, *buffer)
+	if err != nil {
+		return n, err
+	}
+
+	// from was shut down for writing, pass that on so the peer can still answer
+	// (*net.TCPConn, *net.UnixConn and *tls.Conn support this)
+	if cw, ok := to.(interface{ CloseWrite() error }); ok {
+		if err := cw.CloseWrite(); err != nil {
+			return n, writeError{err}
+		}
+		return n, nil
+	}
+	return n, io.EOF // no half-close possible, end the whole connection
+}
+
+// proxyConnection copies data in both directions, after passing on what was
+// already read from the client for routing. A clean end of one direction is
+// forwarded as a half-close, both connections are closed once both directions
+// are done or as soon as one of them fails. The summary logged at the end
+// covers the whole connection since it was accepted.
+func (p *Proxy) proxyConnection(connOutwards net.Conn, connBackend net.Conn, client string, peeked []byte, accepted time.Time) {
+	defer p.connectionClosed()
+	defer p.trackProxied(connOutwards, connBackend)()
+
+	if len(peeked) > 0 {
+		if _, err := connBackend.Write(peeked); err != nil {
+			p.connectionFailed(client, &connError{"backend", connBackend.RemoteAddr(), err})
+			connOutwards.Close()
+			connBackend.Close()
+			return
+		}
+		atomic.AddInt64(&p.metrics.bytesIn, int64(len(peeked)))
+	}
+
+	deadlines := p.newIdleDeadlines(connOutwards, connBackend)
+
+	// the byte counts are only read once both directions reported on errs
+	var bytesIn, bytesOut int64
+	errs := make(chan error, 2)
+	go func() {
+		n, err := p.proxyNetworkConnections(connOutwards, connBackend, true, deadlines)
+		bytesIn = int64(len(peeked)) + n
+		errs <- blame(err, connOutwards, connBackend, "client", "backend")
+	}()
+	go func() {
+		var err error
+		bytesOut, err = p.proxyNetworkConnections(connBackend, connOutwards, false, deadlines)
+		errs <- blame(err, connBackend, connOutwards, "backend", "client")
+	}()
+
+	pending := 2
+	err := <-errs
+	pending--
+	if err == nil {
+		err = <-errs
+		pending--
+	}
+
+	// a clean end would pass a truncated response off as complete, so reset the
+	// client instead if the backend broke, rather than just being idle
+	var connErr *connError
+	if errors.As(err, &connErr) && connErr.side == "backend" && !errors.Is(err, os.ErrDeadlineExceeded) {
+		if tcpConn, ok := connOutwards.(*net.TCPConn); ok {
+			tcpConn.SetLinger(0)
+		}
+	}
+	connOutwards.Close()
+	connBackend.Close()
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		p.log.Info("connection idle timeout reached", "client", client, "side", connErr.side)
+	} else if err != nil && err != io.EOF {
+		p.connectionFailed(client, err)
+	}
+	if pending > 0 {
+		<-errs
+	}
+
+	p.log.Info("connection closed", "client", client, "bytes_in", bytesIn, "bytes_out", bytesOut, "duration", time.Since(accepted))
+}
+
+// trackProxied registers the connections being proxied, for closing them
+// when draining times out, until the returned function is called.
+func (p *Proxy) trackProxied(conns ...net.Conn) func() {
+	p.proxiedMu.Lock()
+	defer p.proxiedMu.Unlock()
+	if p.proxied == nil {
+		p.proxied = make(map[net.Conn]struct{})
+	}
+	for _, conn := range conns {
+		p.proxied[conn] = struct{}{}
+	}
+	return func() {
+		p.proxiedMu.Lock()
+		defer p.proxiedMu.Unlock()
+		for _, conn := range conns {
+			delete(p.proxied, conn)
+		}
+	}
+}
+
+// closeProxied closes both sides of the connections still being proxied.
+func (p *Proxy) closeProxied() {
+	p.proxiedMu.Lock()
+	defer p.proxiedMu.Unlock()
+	for conn := range p.proxied {
+		conn.Close()
+	}
+}
+
+// connectionFailed logs why a proxied connection broke and counts that for
+// the side it broke on.
+func (p *Proxy) connectionFailed(client string, err error) {
+	var connErr *connError
+	if !errors.As(err, &connErr) {
+		p.log.Warn("connection failed", "client", client, "err", err)
+		return
+	}
+	if connErr.side == "backend" {
+		atomic.AddInt64(&p.metrics.backendErrors, 1)
+	} else {
+		atomic.AddInt64(&p.metrics.clientErrors, 1)
+	}
+	p.log.Warn("connection failed", "client", client, "side", connErr.side, "remote", connErr.addr, "err", connErr.err)
+}
+
+// clientName identifies the client of an accepted connection for logging. The
+// activated socket may be a TCP or a Unix stream socket, clients of the latter
+// are identified by their credentials.
+func clientName(conn net.Conn) string {
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		if cred, ok := peerCredentials(unixConn); ok {
+			return cred
+		}
+		return conn.LocalAddr().String()
+	}
+	return conn.RemoteAddr().String()
+}
+
+// tuneConnection applies the TCP options to conn, or the connection below
+// TLS, other connection types like Unix sockets are left alone.
+func (p *Proxy) tuneConnection(conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	if p.config.KeepAlive > 0 {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(p.config.KeepAlive)
+	} else {
+		tcpConn.SetKeepAlive(false)
+	}
+	tcpConn.SetNoDelay(p.config.NoDelay)
+}
+
+// connectionClosed releases a connection from activeConnections and its slot. It also counts
+// as activity, so the inactivity timeout starts once the last connection is gone.
+func (p *Proxy) connectionClosed() {
+	atomic.AddInt64(&p.activeConnections, -1)
+	if p.connSlots != nil {
+		<-p.connSlots
+	}
+	poke(&p.lastActivity)
+}
+
+// releaseWaitSlot releases the slot taken before accepting in wait mode, for
+// connections that are dropped before they are proxied.
+func (p *Proxy) releaseWaitSlot() {
+	if p.connSlots != nil && p.config.MaxConnsAction == "wait" {
+		<-p.connSlots
+	}
+}
+
+// errNoRoute is returned by peekRoute for an HTTP host without backend.
+type errNoRoute string
+
+func (e errNoRoute) Error() string { return fmt.Sprintf("no backend for host %q", string(e)) }
+
+// peekRoute chooses the backend of a connection by the server name of its TLS
+// ClientHello or the host of its first HTTP request, returning an empty route
+// for the default round-robin, and that name or host. The bytes read for that must still be passed on
+// to the backend. Subsequent requests on a keep-alive connection stay with the
+// backend of the first one.
+func (p *Proxy) peekRoute(conn net.Conn, client string) (string, string, []byte, error) {
+	switch {
+	case p.sniRoutes != nil:
+		serverName, hello, err := peekServerName(conn)
+		if err != nil {
+			return "", "", nil, err
+		}
+		route := p.sniRoutes[serverName]
+		p.log.Debug("routing by server name", "client", client, "server_name", serverName, "backend", route)
+		return route, serverName, hello, nil
+
+	case p.config.Mode == "http":
+		host, head, err := peekHTTPHost(conn)
+		if err != nil {
+			return "", "", nil, err
+		}
+		route, ok := p.httpRoutes[host]
+		if !ok {
+			route = p.config.HTTPDefault
+		}
+		// a route expression may still find one
+		if route == "" && p.routeExpr == nil {
+			return "", "", nil, errNoRoute(host)
+		}
+		p.log.Debug("routing by host", "client", client, "host", host, "backend", route)
+		return route, host, head, nil
+	}
+	return "", "", nil, nil
+}
+
+// tcpListeners returns the listeners of the sockets passed by systemd, or of
+// the configured listen address when running standalone.
+func (p *Proxy) tcpListeners() ([]net.Listener, error) {
+	if p.config.Listen != "" {
+		l, err := net.Listen(backendNetwork(p.config.Listen))
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+
+	files, err := activatedFiles(p.config.FdName)
+	if err != nil {
+		return nil, err
+	}
+	// the listeners use duplicates of the passed sockets
+	var listeners []net.Listener
+	for i, f := range files {
+		l, err := net.FileListener(f)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			for _, f := range files[i:] {
+				f.Close()
+			}
+			return nil, err
+		}
+		f.Close()
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// maxAcceptDelay caps the backoff after temporary accept errors.
+const maxAcceptDelay = time.Second
+
+// temporaryAcceptError reports whether accepting may work again later, as
+// opposed to a listener that failed for good, e.g. because it was closed.
+func temporaryAcceptError(err error) bool {
+	if errors.Is(err, net.ErrClosed) {
+		return false
+	}
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNABORTED, syscall.EINTR} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// nextAcceptDelay doubles the delay after a temporary accept error, starting
+// at 5ms like net/http does.
+func nextAcceptDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return 5 * time.Millisecond
+	}
+	if delay *= 2; delay > maxAcceptDelay {
+		delay = maxAcceptDelay
+	}
+	return delay
+}
+
+// startTCPProxy accepts connections until the listeners fail or the proxy is
+// stopped. On stop, it waits up to the drain timeout for open connections to
+// end, then closes those still proxied.
+func (p *Proxy) startTCPProxy() error {
+	listeners, err := p.tcpListeners()
+	if err != nil {
+		return err
+	}
+	for _, l := range listeners {
+		defer l.Close()
+	}
+
+	var wg sync.WaitGroup
+
+	if p.queue != nil {
+		go p.drainQueue()
+	}
+
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			p.acceptTCPConnections(l)
+		}(l)
+	}
+
+	notifyReady(p.log)
+
+	// closing the listeners makes the accept loops return
+	go func() {
+		<-p.shutdown
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	wg.Wait()
+
+	select {
+	case <-p.shutdown:
+		if !p.waitForConnections(p.config.DrainTimeout) {
+			p.log.Warn("drain timeout exceeded, closing connections", "timeout", p.config.DrainTimeout, "connections", atomic.LoadInt64(&p.activeConnections))
+			p.closeProxied()
+		}
+	default:
+	}
+	return nil
+}
+
+// waitForConnections waits until all connections are closed, returning false if
+// there are still some left after timeout.
+func (p *Proxy) waitForConnections(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&p.activeConnections) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+func (p *Proxy) acceptTCPConnections(l net.Listener) {
+	var acceptDelay time.Duration
+	queueLogged := false
+
+	for {
+		poke(&p.lastActivity)
+
+		// when waiting for a free slot, don't accept at all, the kernel queues new connections meanwhile
+		if p.connSlots != nil && p.config.MaxConnsAction == "wait" {
+			select {
+			case p.connSlots <- struct{}{}:
+			case <-p.shutdown:
+				return
+			}
+		}
+
+		// like waiting for a slot, hold off accepting until the rate allows another connection
+		if p.acceptLimit != nil && p.config.AcceptRateAction == "wait" {
+			if delay := p.acceptLimit.reserve(); delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-p.shutdown:
+					return
+				}
+			}
+		}
+
+		connOutwards, err := l.Accept()
+		if err != nil {
+			select {
+			case <-p.shutdown:
+				return
+			default:
+			}
+
+			// e.g. out of file descriptors, back off until connections were closed
+			if temporaryAcceptError(err) {
+				p.releaseWaitSlot()
+				acceptDelay = nextAcceptDelay(acceptDelay)
+				p.log.Warn("accepting connection failed, retrying", "delay", acceptDelay, "err", err)
+				select {
+				case <-time.After(acceptDelay):
+				case <-p.shutdown:
+					return
+				}
+				continue
+			}
+			p.log.Error("accepting connection failed", "err", err)
+			return
+		}
+		acceptDelay = 0
+		accepted := time.Now()
+
+		if !p.clientAllowed(connOutwards.RemoteAddr()) {
+			p.log.Warn("client not allowed, rejecting connection", "client", connOutwards.RemoteAddr())
+			connOutwards.Close()
+			p.releaseWaitSlot()
+			continue
+		}
+
+		if p.acceptLimit != nil && p.config.AcceptRateAction == "reject" && !p.acceptLimit.allow() {
+			p.log.Warn("accept rate exceeded, rejecting connection", "client", clientName(connOutwards), "accept_rate", p.config.AcceptRate)
+			connOutwards.Close()
+			p.releaseWaitSlot()
+			continue
+		}
+
+		if err := p.lazyStart(clientName(connOutwards)); err != nil {
+			connOutwards.Close()
+			continue
+		}
+		// show how many clients piled up while the unit was starting
+		if !queueLogged {
+			if queued, ok := acceptQueueLength(l); ok && queued > 0 {
+				p.log.Info("connections queued while starting", "queued", queued)
+			}
+			queueLogged = true
+		}
+
+		if p.connSlots != nil && p.config.MaxConnsAction == "reject" {
+			select {
+			case p.connSlots <- struct{}{}:
+			default:
+				p.log.Warn("connection limit reached, rejecting connection", "client", clientName(connOutwards), "max_conns", p.config.MaxConns)
+				connOutwards.Close()
+				continue
+			}
+		}
+		atomic.AddInt64(&p.activeConnections, 1)
+		atomic.AddInt64(&p.metrics.connections, 1)
+
+		go p.handleConnection(pendingConn{conn: connOutwards, client: clientName(connOutwards), accepted: accepted}, l.Addr())
+	}
+}
+
+// handleConnection reads the PROXY protocol header of an accepted
+// connection, if any, and hands it off or routes it. Like routing, reading
+// the header waits for the client, so it doesn't run in the accept loop.
+func (p *Proxy) handleConnection(c pendingConn, listenAddr net.Addr) {
+	// the addresses announced to the backend, the activated socket is the destination
+	c.src, c.dst = c.conn.RemoteAddr(), c.conn.LocalAddr()
+	if p.config.AcceptProxyProtocol {
+		announcedSrc, announcedDst, err := readProxyProtocolHeader(c.conn)
+		if err != nil {
+			p.log.Error("reading PROXY protocol header failed, dropping connection", "client", c.client, "err", err)
+			c.conn.Close()
+			p.connectionClosed()
+			return
+		}
+		if announcedSrc != nil {
+			c.src, c.dst = announcedSrc, announcedDst
+			c.client = c.src.String()
+		}
+	}
+	p.log.Info("connection accepted", "client", c.client)
+	p.tuneConnection(c.conn)
+
+	// the backend takes over the connection, the proxy is out of the data path then
+	if p.config.FdHandoffSocket != "" {
+		p.noteAccepted(c.accepted)
+		if err := p.handOffConnection(c.conn, c.client, atomic.LoadInt32(&p.backendReached) == 1); err != nil {
+			p.log.Warn("handing off connection failed, dropping connection", "client", c.client, "err", err)
+		} else {
+			p.noteBackendReached(c.client)
+			p.log.Info("connection handed off", "client", c.client, "socket", p.config.FdHandoffSocket)
+		}
+		c.conn.Close()
+		p.connectionClosed()
+		return
+	}
+
+	// diverted clients go where they were headed, read before TLS hides the socket
+	var original *net.TCPAddr
+	if p.config.Transparent {
+		var err error
+		original, err = originalDestination(c.conn)
+		if err == nil && original.String() == listenAddr.String() {
+			err = errors.New("connection is for the proxy itself")
+		}
+		if err != nil {
+			p.log.Warn("finding original destination failed, dropping connection", "client", c.client, "err", err)
+			c.conn.Close()
+			p.connectionClosed()
+			return
+		}
+		p.log.Debug("forwarding to original destination", "client", c.client, "destination", original)
+		c.dst = original
+	}
+
+	p.routeConnection(c, original)
+}
+
+// routeConnection reads what c is routed by, if anything, and forwards it.
+func (p *Proxy) routeConnection(c pendingConn, original *net.TCPAddr) {
+	if p.tlsConfig != nil {
+		// the handshake happens on the first read
+		c.conn = tls.Server(c.conn, p.tlsConfig)
+	}
+
+	var err error
+	c.route, c.host, c.peeked, err = p.peekRoute(c.conn, c.client)
+	if err == nil && original != nil {
+		c.route = original.String()
+	}
+	if err == nil && p.routeExpr != nil {
+		c.route, err = p.exprRoute(c.route, c.src, c.conn.LocalAddr(), c.host)
+	}
+	if err != nil {
+		var noRoute errNoRoute
+		var badRoute errBadRoute
+		if errors.As(err, &noRoute) {
+			p.log.Warn("no backend for host, rejecting request", "client", c.client, "host", string(noRoute))
+			writeBadGateway(c.conn, string(noRoute))
+		} else if errors.As(err, &badRoute) {
+			p.log.Error("route expression gave an invalid backend, dropping connection", "client", c.client, "err", badRoute.err)
+		} else {
+			p.log.Warn("reading connection for routing failed, dropping connection", "client", c.client, "err", err)
+		}
+		c.conn.Close()
+		p.connectionClosed()
+		return
+	}
+
+	// while the backend wasn't reachable yet, park connections instead of dialing for each in turn
+	if p.queue != nil && atomic.LoadInt32(&p.backendReached) == 0 {
+		p.enqueue(c)
+		return
+	}
+	p.forwardConnection(c, atomic.LoadInt32(&p.backendReached) == 1)
+}
+
+// pendingConn is an accepted connection, routed but not yet connected to its backend.
+type pendingConn struct {
+	conn     net.Conn
+	client   string
+	src, dst net.Addr // the addresses announced to the backend
+	route    string   // backend routed to, empty for the default ones
+	host     string   // server name or host routed by
+	peeked   []byte   // read from conn for routing already
+	accepted time.Time
+
+	deadline time.Time   // when a queued connection is dropped, zero if it isn't queued
+	expiry   *time.Timer // drops a queued connection at deadline
+}
+
+// forwardConnection connects c to its backend and proxies it. It reports
+// whether the backend could be reached.
+func (p *Proxy) forwardConnection(c pendingConn, hadSuccessfulConnection bool) bool {
+	p.noteAccepted(c.accepted)
+	if p.execArgs != nil {
+		connBackend, err := p.spawnBackend(c.client)
+		if err != nil {
+			p.log.Warn("starting command failed, dropping connection", "client", c.client, "err", err)
+			c.conn.Close()
+			p.connectionClosed()
+			return false
+		}
+		atomic.StoreInt32(&p.backendReached, 1)
+		p.noteBackendReached(c.client)
+		go p.proxyConnection(noHalfClose{c.conn}, connBackend, c.client, c.peeked, c.accepted)
+		return true
+	}
+
+	var connBackend net.Conn
+	if p.pool != nil && c.route == "" {
+		connBackend = p.takePooled()
+	}
+	if connBackend == nil {
+		var err error
+		connBackend, err = p.dialBackend(hadSuccessfulConnection, c.route, connectionVars(c.conn.LocalAddr(), c.host), c.deadline)
+		if err != nil {
+			// only this connection is affected, the others keep going
+			p.log.Warn("backend connection failed, dropping connection", "client", c.client, "err", err)
+			c.conn.Close()
+			p.connectionClosed()
+			return false
+		}
+		p.tuneConnection(connBackend)
+	}
+	p.noteBackendReached(c.client)
+
+	if err := p.sendProxyProtocolHeader(connBackend, c.src, c.dst); err != nil {
+		p.log.Warn("sending PROXY protocol header failed, dropping connection", "client", c.client, "err", err)
+		c.conn.Close()
+		connBackend.Close()
+		p.connectionClosed()
+		return true
+	}
+
+	go p.proxyConnection(c.conn, connBackend, c.client, c.peeked, c.accepted)
+	return true
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// loopbackPair returns both ends of a TCP connection over the loopback interface.
+func loopbackPair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	tb.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	conn := <-accepted
+	if conn == nil {
+		tb.Fatal("accepting the loopback connection failed")
+	}
+	return dialed.(*net.TCPConn), conn.(*net.TCPConn)
+}
+
+func newBenchmarkProxy(b *testing.B) *Proxy {
+	b.Helper()
+	p, err := New(Config{
+		Mode:             "tcp",
+		Destination:      "127.0.0.1:1",
+		NoUnit:           true,
+		MaxConnsAction:   "wait",
+		AcceptRateAction: "wait",
+		Logger:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return p
+}
+
+// BenchmarkProxyConnection proxies many short connections, each sending a
+// request and reading a response of size bytes, which is where taking the
+// copy buffers from the pool instead of allocating them pays off. The make
+// variant empties the pool before every connection, allocating the
+// buffers like without it, for comparison with -benchmem.
+func BenchmarkProxyConnection(b *testing.B) {
+	for _, size := range []int{512, 64 * 1024} {
+		for _, pooled := range []bool{true, false} {
+			name := fmt.Sprintf("%dB/pooled", size)
+			if !pooled {
+				name = fmt.Sprintf("%dB/make", size)
+			}
+			b.Run(name, func(b *testing.B) {
+				benchmarkProxyConnection(b, size, pooled)
+			})
+		}
+	}
+}
+
+func benchmarkProxyConnection(b *testing.B, size int, pooled bool) {
+	p := newBenchmarkProxy(b)
+	newBuffer := p.buffers.New
+	payload := make([]byte, size)
+	response := make([]byte, size)
+
+	b.SetBytes(int64(2 * size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !pooled {
+			p.buffers = sync.Pool{New: newBuffer}
+		}
+		client, connOutwards := loopbackPair(b)
+		connBackend, backend := loopbackPair(b)
+
+		go func() {
+			io.Copy(io.Discard, backend)
+			backend.Write(payload)
+			backend.Close()
+		}()
+		atomic.AddInt64(&p.activeConnections, 1) // as on accept, proxyConnection releases it
+		done := make(chan struct{})
+		go func() {
+			p.proxyConnection(connOutwards, connBackend, "client", nil, time.Now())
+			close(done)
+		}()
+
+		client.Write(payload)
+		client.CloseWrite()
+		if _, err := io.ReadFull(client, response); err != nil {
+			b.Fatal(err)
+		}
+		client.Close()
+		<-done
+	}
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader loads a certificate and key pair and reloads it whenever one of
+// the files changed, so certificates can be rotated without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	log      *slog.Logger
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // latest modification time of both files when cert was loaded
+
+	failedModTime time.Time // modification time of the files that last failed to load
+	statFailed    bool      // whether the files couldn't be found on the last handshake
+}
+
+func newCertReloader(certFile string, keyFile string, logger *slog.Logger) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, log: logger}
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTime); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) filesModTime() (time.Time, error) {
+	var modTime time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return modTime, nil
+}
+
+func (r *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+// getCertificate implements tls.Config.GetCertificate. If reloading a changed
+// certificate fails, e.g. because only one of the files was replaced yet, the
+// previous one is used. Each failure is logged once, files that failed to load
+// are only tried again once they change.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTime, err := r.filesModTime()
+	if err != nil {
+		if !r.statFailed {
+			r.log.Warn("reloading TLS certificate failed, using the previous one", "cert", r.certFile, "err", err)
+			r.statFailed = true
+		}
+		return r.cert, nil
+	}
+	r.statFailed = false
+	if modTime.Equal(r.modTime) || modTime.Equal(r.failedModTime) {
+		return r.cert, nil
+	}
+	if err := r.load(modTime); err != nil {
+		r.log.Warn("reloading TLS certificate failed, using the previous one", "cert", r.certFile, "err", err)
+		r.failedModTime = modTime
+		return r.cert, nil
+	}
+	r.log.Info("reloaded TLS certificate", "cert", r.certFile)
+	return r.cert, nil
+}
+
+// reload loads the certificate again, even if the files seem unchanged.
+func (r *certReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+	if err := r.load(modTime); err != nil {
+		return err
+	}
+	r.log.Info("reloaded TLS certificate", "cert", r.certFile)
+	return nil
+}
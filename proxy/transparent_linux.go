@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+)
+
+const (
+	soOriginalDst     = 80 // SO_ORIGINAL_DST of linux/netfilter_ipv4.h
+	ip6tSoOriginalDst = 80 // IP6T_SO_ORIGINAL_DST of linux/netfilter_ipv6/ip6_tables.h
+	ipv6Transparent   = 75 // IPV6_TRANSPARENT of linux/in6.h
+)
+
+// originalDestination returns the address conn was sent to before netfilter
+// diverted it to the proxy: the one recorded by a REDIRECT or DNAT rule, or,
+// for a TPROXY rule, the local address of a socket with IP_TRANSPARENT set.
+func originalDestination(conn net.Conn) (*net.TCPAddr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("only TCP connections have an original destination")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	local := tcpConn.LocalAddr().(*net.TCPAddr)
+
+	var original *net.TCPAddr
+	transparent := 0
+	err = raw.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			// the kernel fills in a sockaddr_in, which fits into an IPv6Mreq
+			if mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); err == nil {
+				a := mreq.Multiaddr
+				original = &net.TCPAddr{IP: net.IPv4(a[4], a[5], a[6], a[7]), Port: int(a[2])<<8 | int(a[3])}
+			}
+			transparent, _ = syscall.GetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT)
+			return
+		}
+		// and a sockaddr_in6 at the start of an IPv6MTUInfo
+		if info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, ip6tSoOriginalDst); err == nil {
+			var port [2]byte
+			binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+			original = &net.TCPAddr{IP: append(net.IP(nil), info.Addr.Addr[:]...), Port: int(binary.BigEndian.Uint16(port[:]))}
+		}
+		transparent, _ = syscall.GetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// without NAT, connection tracking reports the local address as well
+	if original != nil && !(original.IP.Equal(local.IP) && original.Port == local.Port) {
+		return original, nil
+	}
+	if transparent == 1 {
+		return local, nil
+	}
+	return nil, errors.New("connection was neither redirected nor accepted on a transparent socket")
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+// originalDestination is only supported on Linux.
+func originalDestination(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errors.New("forwarding to the original destination is only supported on Linux")
+}
@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func (p *Proxy) startUDPProxy() error {
+	pc, err := p.udpConn()
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	notifyReady(p.log)
+
+	go func() {
+		<-p.shutdown
+		pc.Close()
+	}()
+
+	// UDP has no connections, so map every client source address to its own
+	// backend socket; replies on that socket belong to exactly that client.
+	clients := udpClients{clients: make(map[string]*udpClient)}
+	buffer := make([]byte, 65535)
+
+	for {
+		i, clientAddr, err := pc.ReadFrom(buffer)
+		if err != nil {
+			select {
+			case <-p.shutdown:
+			default:
+				p.log.Error("reading from socket failed", "err", err)
+			}
+			return nil
+		}
+		poke(&p.lastActivity)
+		if err := p.lazyStart(clientAddr.String()); err != nil {
+			return nil
+		}
+		atomic.AddInt64(&p.metrics.bytesIn, int64(i))
+
+		// looked up, refreshed and written to under the lock, so the client
+		// can't expire in between
+		clients.mu.Lock()
+		client, ok := clients.clients[clientAddr.String()]
+		if !ok {
+			client, err = p.dialUDPClient(pc, clientAddr)
+			if err != nil {
+				clients.mu.Unlock()
+				p.log.Warn("connecting to backend failed", "client", clientAddr, "err", err)
+				continue
+			}
+			clients.clients[clientAddr.String()] = client
+			go p.proxyDatagrams(&clients, client, pc, clientAddr)
+		}
+		client.refresh(p.config.UDPClientTimeout)
+		if _, err := client.conn.Write(buffer[:i]); err != nil {
+			p.log.Debug("writing to backend failed", "client", clientAddr, "err", err)
+		}
+		clients.mu.Unlock()
+	}
+}
+
+// udpClients are the backend sockets of the UDP clients by address.
+type udpClients struct {
+	mu      sync.Mutex
+	clients map[string]*udpClient
+}
+
+// udpClient is the backend socket of a UDP client, forgotten once it saw no
+// datagram in either direction for UDPClientTimeout.
+type udpClient struct {
+	conn    *net.UDPConn
+	expires time.Time // guarded by udpClients.mu
+}
+
+// refresh moves the expiry of c timeout into the future, with the lock of
+// its udpClients held.
+func (c *udpClient) refresh(timeout time.Duration) {
+	c.expires = time.Now().Add(timeout)
+	c.conn.SetReadDeadline(c.expires)
+}
+
+// dialUDPClient connects a new client to the next backend round-robin,
+// trying the others if that fails.
+func (p *Proxy) dialUDPClient(pc net.PacketConn, clientAddr net.Addr) (*udpClient, error) {
+	vars := connectionVars(pc.LocalAddr(), "")
+	var err error
+	for _, backend := range p.nextBackends() {
+		backend = vars.expand(backend)
+		var conn *net.UDPConn
+		conn, err = p.dialUDPBackend(backend)
+		if err == nil {
+			p.log.Debug("new client", "client", clientAddr, "backend", backend)
+			return &udpClient{conn: conn}, nil
+		}
+		p.log.Debug("backend failed", "client", clientAddr, "backend", backend, "err", err)
+	}
+	return nil, err
+}
+
+// udpConn returns the socket passed by systemd, or one bound to the configured
+// listen address when running standalone.
+func (p *Proxy) udpConn() (net.PacketConn, error) {
+	if p.config.Listen != "" {
+		return net.ListenPacket("udp", p.config.Listen)
+	}
+
+	files, err := activatedFiles(p.config.FdName)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) != 1 {
+		for _, f := range files {
+			f.Close()
+		}
+		return nil, fmt.Errorf("udp mode serves exactly one socket, systemd passed %d", len(files))
+	}
+	// the connection uses a duplicate of the passed socket
+	defer files[0].Close()
+	return net.FilePacketConn(files[0])
+}
+
+func (p *Proxy) dialUDPBackend(backend string) (*net.UDPConn, error) {
+	conn, err := p.dialer("udp").Dial("udp", backend)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// proxyDatagrams relays the replies of a client's backend socket until the
+// client expired, then forgets it.
+func (p *Proxy) proxyDatagrams(clients *udpClients, client *udpClient, to net.PacketConn, clientAddr net.Addr) {
+	buffer := make([]byte, 65535)
+
+	for {
+		i, err := client.conn.Read(buffer)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			clients.mu.Lock()
+			if time.Now().Before(client.expires) {
+				// a datagram from the client came in meanwhile
+				client.conn.SetReadDeadline(client.expires)
+				clients.mu.Unlock()
+				continue
+			}
+			delete(clients.clients, clientAddr.String())
+			client.conn.Close()
+			clients.mu.Unlock()
+			p.log.Debug("client expired", "client", clientAddr)
+			return
+		}
+		if err != nil {
+			clients.mu.Lock()
+			delete(clients.clients, clientAddr.String())
+			client.conn.Close()
+			clients.mu.Unlock()
+			p.log.Debug("reading from backend failed", "client", clientAddr, "err", err)
+			return
+		}
+		clients.mu.Lock()
+		client.refresh(p.config.UDPClientTimeout)
+		clients.mu.Unlock()
+		poke(&p.lastActivity)
+		atomic.AddInt64(&p.metrics.bytesOut, int64(i))
+		if _, err := to.WriteTo(buffer[:i], clientAddr); err != nil {
+			p.log.Debug("writing to client failed", "client", clientAddr, "err", err)
+		}
+	}
+}
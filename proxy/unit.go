@@ -0,0 +1,440 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus"
+)
+
+// busConnectAttempts is how often connecting to D-Bus is tried before giving up
+const busConnectAttempts = 5
+
+// startJobModes and stopJobModes are the job modes systemd accepts for
+// starting and stopping a unit.
+var (
+	startJobModes = []string{"replace", "fail", "isolate", "ignore-dependencies", "ignore-requirements", "replace-irreversibly", "flush"}
+	stopJobModes  = []string{"replace", "fail", "ignore-dependencies", "ignore-requirements", "replace-irreversibly", "flush", "triggering"}
+)
+
+// unitManager starts and stops the units of the proxy. unitController does
+// so on systemd's D-Bus API, dryRunUnits only pretends to, without a bus.
+type unitManager interface {
+	startSystemdUnit() ([]string, error)
+	restartSystemdUnit() ([]string, error)
+	stopSystemdUnit(units []string) error
+	killSystemdUnit(signal int32, units []string) error
+	inactiveUnit() (string, string, error)
+	waitUntilActive(timeout time.Duration) error
+	checkUnitsExist() error
+	Close() error
+}
+
+type unitController struct {
+	conn      *dbus.Conn
+	unitnames []string // started in this order, stopped in reverse
+	log       *slog.Logger
+	startMode string // job mode for starting the unit, "replace" if empty
+	stopMode  string // job mode for stopping the unit, "replace" if empty
+
+	jobTimeout time.Duration // maximum time to wait for start jobs to finish, 0 for no limit
+}
+
+func newUnitController(names []string, user bool, address string, logger *slog.Logger) (unitController, error) {
+	// an explicit address wins, e.g. in containers where bus discovery fails
+	if address != "" {
+		conn, err := dialBus(address)
+		if err != nil {
+			return unitController{}, err
+		}
+		return unitController{conn: conn, unitnames: names, log: logger}, nil
+	}
+
+	// Connect to SystemBus if user is false, otherwise connect to SessionBus
+	if user {
+		conn, err := dbus.SessionBus()
+		if err != nil {
+			return unitController{}, err
+		}
+		return unitController{conn: conn, unitnames: names, log: logger}, nil
+	}
+	// Connect to SystemBus
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return unitController{}, err
+	}
+	return unitController{conn: conn, unitnames: names, log: logger}, nil
+}
+
+// Close closes the bus connection, if there is one.
+func (unitCtrl unitController) Close() error {
+	if unitCtrl.conn == nil {
+		return nil
+	}
+	return unitCtrl.conn.Close()
+}
+
+// dialBus connects to the bus at address, e.g. unix:path=/run/dbus/system_bus_socket.
+func dialBus(address string) (*dbus.Conn, error) {
+	conn, err := dbus.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Auth(nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.Hello(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// instanceUnitName expands a template unit like "myapp@.service" (or one using
+// the %i specifier, like "myapp@%i.service") into the unit of the given instance.
+func instanceUnitName(name string, instance string) (string, error) {
+	if strings.Contains(name, "%i") {
+		if instance == "" {
+			return "", fmt.Errorf("unit %s needs an instance", name)
+		}
+		return strings.Replace(name, "%i", instance, -1), nil
+	}
+
+	at := strings.LastIndex(name, "@")
+	dot := strings.LastIndex(name, ".")
+	if at < 0 || dot != at+1 {
+		// not a template, use as is
+		return name, nil
+	}
+	if instance == "" {
+		return "", fmt.Errorf("template unit %s needs an instance", name)
+	}
+	return name[:at+1] + instance + name[dot:], nil
+}
+
+// signalNumbers are the Linux numbers of the signals worth sending a unit by name.
+var signalNumbers = map[string]int32{
+	"SIGHUP": 1, "SIGINT": 2, "SIGQUIT": 3, "SIGKILL": 9, "SIGUSR1": 10,
+	"SIGUSR2": 12, "SIGTERM": 15, "SIGCONT": 18, "SIGSTOP": 19, "SIGWINCH": 28,
+}
+
+// signalNumber parses a signal given by name like SIGUSR1 or USR1, or by number.
+func signalNumber(signal string) (int32, error) {
+	name := strings.ToUpper(signal)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if number, ok := signalNumbers[name]; ok {
+		return number, nil
+	}
+	number, err := strconv.Atoi(signal)
+	if err != nil || number < 1 || number > 64 {
+		return 0, fmt.Errorf("unknown signal %q", signal)
+	}
+	return int32(number), nil
+}
+
+// validJobMode returns an error if mode is not one of modes.
+func validJobMode(mode string, modes []string) error {
+	for _, m := range modes {
+		if mode == m {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown job mode %q, available: %s", mode, strings.Join(modes, ", "))
+}
+
+// jobMode returns mode, defaulting to systemctl's "replace".
+func jobMode(mode string) string {
+	if mode == "" {
+		return "replace"
+	}
+	return mode
+}
+
+// connectUnitController retries connecting to the bus a few times with backoff,
+// so a bus that is momentarily unavailable doesn't abort the proxy.
+func connectUnitController(names []string, user bool, address string, logger *slog.Logger) (unitController, error) {
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		unitCtrl, err := newUnitController(names, user, address, logger)
+		if err == nil || attempt == busConnectAttempts {
+			return unitCtrl, err
+		}
+		logger.Warn("connecting to D-Bus failed, retrying", "attempt", attempt, "delay", delay, "err", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// startSystemdUnit starts the units that aren't active yet and returns them.
+// Active ones are left alone, as starting them again restarts some units.
+func (unitCtrl unitController) startSystemdUnit() ([]string, error) {
+	var units []string
+	for _, unit := range unitCtrl.unitnames {
+		if state, err := unitCtrl.activeState(unit); err == nil && state == "active" {
+			unitCtrl.log.Info("unit already active, not starting it", "unit", unit)
+			continue
+		}
+		units = append(units, unit)
+	}
+	if len(units) == 0 {
+		return nil, nil
+	}
+	return unitCtrl.runStartJobs("StartUnit", units)
+}
+
+// restartSystemdUnit restarts all units, active or not, e.g. because an active
+// one hung, and returns them.
+func (unitCtrl unitController) restartSystemdUnit() ([]string, error) {
+	return unitCtrl.runStartJobs("RestartUnit", unitCtrl.unitnames)
+}
+
+// runStartJobs calls method, StartUnit or RestartUnit, for the units in order
+// and waits until all of their jobs finished.
+func (unitCtrl unitController) runStartJobs(method string, units []string) ([]string, error) {
+	// subscribe to job signals before starting, so the job can't finish unnoticed
+	jobs, err := unitCtrl.subscribeJobRemoved()
+	if err != nil {
+		return nil, err
+	}
+	defer unitCtrl.conn.RemoveSignal(jobs)
+
+	startTime := time.Now()
+	obj := unitCtrl.conn.Object("org.freedesktop.systemd1", dbus.ObjectPath("/org/freedesktop/systemd1"))
+	responseObjPaths := make([]dbus.ObjectPath, len(units))
+	for i, unit := range units {
+		unitCtrl.log.Info("starting unit", "unit", unit)
+		err = obj.Call("org.freedesktop.systemd1.Manager."+method, 0, unit, jobMode(unitCtrl.startMode)).Store(&responseObjPaths[i])
+		if err != nil {
+			return units[:i], err
+		}
+	}
+
+	// block until all start jobs are finished, the units are only up then
+	results, err := waitForJobs(jobs, responseObjPaths, unitCtrl.jobTimeout)
+	if err != nil {
+		return units, err
+	}
+	for i, unit := range units {
+		if err := jobError(unit, results[i]); err != nil {
+			return units, err
+		}
+	}
+	for _, unit := range units {
+		unitCtrl.log.Info("unit started", "unit", unit, "duration", time.Since(startTime))
+	}
+	return units, nil
+}
+
+// unitProperty loads the unit and returns one of its string properties, e.g. ActiveState.
+func (unitCtrl unitController) unitProperty(unit string, property string) (string, error) {
+	var unitPath dbus.ObjectPath
+	obj := unitCtrl.conn.Object("org.freedesktop.systemd1", dbus.ObjectPath("/org/freedesktop/systemd1"))
+	err := obj.Call("org.freedesktop.systemd1.Manager.LoadUnit", 0, unit).Store(&unitPath)
+	if err != nil {
+		return "", err
+	}
+
+	value, err := unitCtrl.conn.Object("org.freedesktop.systemd1", unitPath).GetProperty("org.freedesktop.systemd1.Unit." + property)
+	if err != nil {
+		return "", err
+	}
+	s, _ := value.Value().(string)
+	return s, nil
+}
+
+// activeState returns the unit's ActiveState, e.g. "active" or "activating".
+func (unitCtrl unitController) activeState(unit string) (string, error) {
+	return unitCtrl.unitProperty(unit, "ActiveState")
+}
+
+// inactiveUnit returns the first unit that isn't active, with its ActiveState,
+// or an empty name if all are.
+func (unitCtrl unitController) inactiveUnit() (string, string, error) {
+	for _, unit := range unitCtrl.unitnames {
+		state, err := unitCtrl.activeState(unit)
+		if err != nil {
+			return "", "", err
+		}
+		if state != "active" {
+			return unit, state, nil
+		}
+	}
+	return "", "", nil
+}
+
+// checkUnitsExist makes sure systemd can load all units, so a typo in a unit
+// name fails right away instead of on the first start.
+func (unitCtrl unitController) checkUnitsExist() error {
+	for _, unit := range unitCtrl.unitnames {
+		state, err := unitCtrl.unitProperty(unit, "LoadState")
+		if err != nil {
+			return fmt.Errorf("loading unit %s failed: %w", unit, err)
+		}
+		switch state {
+		case "loaded":
+		case "not-found":
+			return fmt.Errorf("unit %s does not exist", unit)
+		case "masked":
+			return fmt.Errorf("unit %s is masked", unit)
+		default:
+			return fmt.Errorf("unit %s can't be loaded, its load state is %q", unit, state)
+		}
+	}
+	return nil
+}
+
+// waitUntilActive polls the units' ActiveState with backoff until all are active.
+func (unitCtrl unitController) waitUntilActive(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for _, unit := range unitCtrl.unitnames {
+		if err := unitCtrl.waitUntilUnitActive(unit, deadline); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (unitCtrl unitController) waitUntilUnitActive(unit string, deadline time.Time) error {
+	delay := 100 * time.Millisecond
+
+	for {
+		state, err := unitCtrl.activeState(unit)
+		if err != nil {
+			return err
+		}
+		switch state {
+		case "active":
+			return nil
+		case "failed", "inactive":
+			return fmt.Errorf("%s is %s", unit, state)
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s still %s at the deadline", unit, state)
+		}
+		time.Sleep(delay)
+		if delay < 2*time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// subscribeJobRemoved returns a channel receiving systemd's JobRemoved signals.
+func (unitCtrl unitController) subscribeJobRemoved() (chan *dbus.Signal, error) {
+	obj := unitCtrl.conn.Object("org.freedesktop.systemd1", dbus.ObjectPath("/org/freedesktop/systemd1"))
+	err := obj.Call("org.freedesktop.systemd1.Manager.Subscribe", 0).Err
+	if err != nil {
+		return nil, err
+	}
+
+	match := "type='signal',interface='org.freedesktop.systemd1.Manager',member='JobRemoved'"
+	err = unitCtrl.conn.BusObject().Call("org.freedesktop.DBus.AddMatch", 0, match).Err
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make(chan *dbus.Signal, 16)
+	unitCtrl.conn.Signal(jobs)
+	return jobs, nil
+}
+
+// waitForJobs waits for the JobRemoved signals of the given jobs and returns
+// their results in the same order. It gives up after timeout, unless that is 0.
+func waitForJobs(jobs <-chan *dbus.Signal, paths []dbus.ObjectPath, timeout time.Duration) ([]string, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	results := make([]string, len(paths))
+	pending := len(paths)
+	for pending > 0 {
+		var signal *dbus.Signal
+		var ok bool
+		select {
+		case signal, ok = <-jobs:
+			if !ok {
+				return results, errors.New("D-Bus connection closed while waiting for start jobs")
+			}
+		case <-expired:
+			return results, fmt.Errorf("start jobs didn't finish within %v", timeout)
+		}
+		// JobRemoved carries (id uint32, job object path, unit string, result string)
+		if signal.Name != "org.freedesktop.systemd1.Manager.JobRemoved" || len(signal.Body) < 4 {
+			continue
+		}
+		path, _ := signal.Body[1].(dbus.ObjectPath)
+		result, _ := signal.Body[3].(string)
+		for i, job := range paths {
+			if job == path && results[i] == "" {
+				results[i] = result
+				pending--
+			}
+		}
+	}
+	return results, nil
+}
+
+// unitStartError is a failed start job, it matches ErrUnitFailed.
+type unitStartError string
+
+func (e unitStartError) Error() string        { return string(e) }
+func (e unitStartError) Is(target error) bool { return target == ErrUnitFailed }
+
+// jobError explains a start job result other than "done" as error.
+func jobError(unit string, result string) error {
+	switch result {
+	case "done":
+		return nil
+	case "failed":
+		return unitStartError(fmt.Sprintf("%s failed to start, see journalctl -u %s", unit, unit))
+	case "dependency":
+		return unitStartError(fmt.Sprintf("a dependency of %s failed to start", unit))
+	case "timeout":
+		return unitStartError(fmt.Sprintf("%s timed out while starting", unit))
+	case "canceled":
+		return unitStartError(fmt.Sprintf("start of %s was canceled", unit))
+	case "skipped":
+		return unitStartError(fmt.Sprintf("start of %s was skipped", unit))
+	}
+	return unitStartError(fmt.Sprintf("start job of %s finished with result %q", unit, result))
+}
+
+// killSystemdUnit sends signal to all processes of the units, in reverse order.
+func (unitCtrl unitController) killSystemdUnit(signal int32, units []string) error {
+	obj := unitCtrl.conn.Object("org.freedesktop.systemd1", dbus.ObjectPath("/org/freedesktop/systemd1"))
+	var errs []error
+	for i := len(units) - 1; i >= 0; i-- {
+		unit := units[i]
+		unitCtrl.log.Info("signaling unit", "unit", unit, "signal", signal)
+		if err := obj.Call("org.freedesktop.systemd1.Manager.KillUnit", 0, unit, "all", signal).Err; err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", unit, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// stopSystemdUnit stops the given units in reverse order, e.g. the app before its
+// sidecar. A failing unit doesn't keep the others running.
+func (unitCtrl unitController) stopSystemdUnit(units []string) error {
+	obj := unitCtrl.conn.Object("org.freedesktop.systemd1", dbus.ObjectPath("/org/freedesktop/systemd1"))
+	var errs []error
+	for i := len(units) - 1; i >= 0; i-- {
+		unit := units[i]
+		unitCtrl.log.Info("stopping unit", "unit", unit)
+		var responseObjPath dbus.ObjectPath
+		if err := obj.Call("org.freedesktop.systemd1.Manager.StopUnit", 0, unit, jobMode(unitCtrl.stopMode)).Store(&responseObjPath); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", unit, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus"
+)
+
+// privateBus runs a dbus-daemon for the test and returns its address. The
+// test is skipped if there is no dbus-daemon.
+func privateBus(t *testing.T) string {
+	t.Helper()
+	path, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("no dbus-daemon to run a private bus")
+	}
+	cmd := exec.Command(path, "--session", "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading the bus address: %v", err)
+	}
+	return strings.TrimSpace(address)
+}
+
+// fakeSystemd implements the parts of systemd's manager API the proxy uses on
+// a bus. Units named fail-* fail to start, the start jobs of hang-* never
+// finish and missing-* don't exist.
+type fakeSystemd struct {
+	conn *dbus.Conn
+
+	mu     sync.Mutex
+	jobs   uint32
+	states map[string]string
+	calls  []string // method and unit of each job, e.g. "StartUnit app.service"
+}
+
+func serveFakeSystemd(t *testing.T, address string) *fakeSystemd {
+	t.Helper()
+	conn, err := dialBus(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	m := &fakeSystemd{conn: conn, states: map[string]string{}}
+	if err := conn.Export(m, "/org/freedesktop/systemd1", "org.freedesktop.systemd1.Manager"); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := conn.RequestName("org.freedesktop.systemd1", dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("requesting the systemd name: %v, %v", reply, err)
+	}
+	return m
+}
+
+// job records a job for unit and finishes it like systemd would, leaving the
+// unit in state if it succeeded.
+func (m *fakeSystemd) job(method string, unit string, state string) dbus.ObjectPath {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobs++
+	id := m.jobs
+	path := dbus.ObjectPath(fmt.Sprintf("/org/freedesktop/systemd1/job/%d", id))
+	m.calls = append(m.calls, method+" "+unit)
+
+	result := "done"
+	switch {
+	case strings.HasPrefix(unit, "hang-"):
+		m.states[unit] = "activating"
+		return path
+	case strings.HasPrefix(unit, "fail-") && state == "active":
+		result = "failed"
+		state = "failed"
+	}
+	m.states[unit] = state
+	go m.conn.Emit("/org/freedesktop/systemd1", "org.freedesktop.systemd1.Manager.JobRemoved", id, path, unit, result)
+	return path
+}
+
+func (m *fakeSystemd) StartUnit(unit string, mode string) (dbus.ObjectPath, *dbus.Error) {
+	return m.job("StartUnit", unit, "active"), nil
+}
+
+func (m *fakeSystemd) RestartUnit(unit string, mode string) (dbus.ObjectPath, *dbus.Error) {
+	return m.job("RestartUnit", unit, "active"), nil
+}
+
+func (m *fakeSystemd) StopUnit(unit string, mode string) (dbus.ObjectPath, *dbus.Error) {
+	return m.job("StopUnit", unit, "inactive"), nil
+}
+
+func (m *fakeSystemd) Subscribe() *dbus.Error { return nil }
+
+func (m *fakeSystemd) LoadUnit(unit string) (dbus.ObjectPath, *dbus.Error) {
+	path := dbus.ObjectPath("/org/freedesktop/systemd1/unit/" + strings.NewReplacer(".", "_2e", "-", "_2d").Replace(unit))
+	if err := m.conn.Export(fakeUnitProperties{m, unit}, path, "org.freedesktop.DBus.Properties"); err != nil {
+		return "", dbus.NewError("org.freedesktop.DBus.Error.Failed", []interface{}{err.Error()})
+	}
+	return path, nil
+}
+
+// jobCalls returns the jobs made so far.
+func (m *fakeSystemd) jobCalls() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.calls...)
+}
+
+// fakeUnitProperties serves the properties of a unit of fakeSystemd.
+type fakeUnitProperties struct {
+	m    *fakeSystemd
+	unit string
+}
+
+func (u fakeUnitProperties) Get(iface string, property string) (dbus.Variant, *dbus.Error) {
+	u.m.mu.Lock()
+	defer u.m.mu.Unlock()
+	switch property {
+	case "LoadState":
+		if strings.HasPrefix(u.unit, "missing-") {
+			return dbus.MakeVariant("not-found"), nil
+		}
+		return dbus.MakeVariant("loaded"), nil
+	case "ActiveState":
+		if state, ok := u.m.states[u.unit]; ok {
+			return dbus.MakeVariant(state), nil
+		}
+		return dbus.MakeVariant("inactive"), nil
+	}
+	return dbus.Variant{}, dbus.NewError("org.freedesktop.DBus.Error.UnknownProperty", []interface{}{property})
+}
+
+// newTestUnitController connects a unitController for units to a fake systemd
+// on a private bus.
+func newTestUnitController(t *testing.T, units ...string) (unitController, *fakeSystemd) {
+	t.Helper()
+	address := privateBus(t)
+	m := serveFakeSystemd(t, address)
+	ctrl, err := newUnitController(units, false, address, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ctrl.Close() })
+	ctrl.jobTimeout = 5 * time.Second
+	return ctrl, m
+}
+
+func TestUnitControllerStartStop(t *testing.T) {
+	ctrl, m := newTestUnitController(t, "app.service", "sidecar.service")
+
+	if err := ctrl.checkUnitsExist(); err != nil {
+		t.Fatalf("checkUnitsExist() = %v", err)
+	}
+	if unit, state, err := ctrl.inactiveUnit(); unit != "app.service" || state != "inactive" || err != nil {
+		t.Fatalf("inactiveUnit() = %q, %q, %v before starting, want app.service inactive", unit, state, err)
+	}
+
+	started, err := ctrl.startSystemdUnit()
+	if err != nil {
+		t.Fatalf("startSystemdUnit() = %v", err)
+	}
+	if want := []string{"app.service", "sidecar.service"}; !reflect.DeepEqual(started, want) {
+		t.Errorf("started %v, want %v", started, want)
+	}
+	if unit, state, err := ctrl.inactiveUnit(); unit != "" || err != nil {
+		t.Errorf("inactiveUnit() = %q, %q, %v after starting, want none", unit, state, err)
+	}
+	if err := ctrl.waitUntilActive(time.Second); err != nil {
+		t.Errorf("waitUntilActive() = %v", err)
+	}
+
+	// active units are left alone by a start, but not by a restart
+	if started, err := ctrl.startSystemdUnit(); len(started) != 0 || err != nil {
+		t.Errorf("startSystemdUnit() = %v, %v with active units, want none started", started, err)
+	}
+	if _, err := ctrl.restartSystemdUnit(); err != nil {
+		t.Errorf("restartSystemdUnit() = %v", err)
+	}
+
+	if err := ctrl.stopSystemdUnit([]string{"app.service", "sidecar.service"}); err != nil {
+		t.Errorf("stopSystemdUnit() = %v", err)
+	}
+
+	want := []string{
+		"StartUnit app.service", "StartUnit sidecar.service",
+		"RestartUnit app.service", "RestartUnit sidecar.service",
+		"StopUnit sidecar.service", "StopUnit app.service",
+	}
+	if calls := m.jobCalls(); !reflect.DeepEqual(calls, want) {
+		t.Errorf("jobs %v, want %v", calls, want)
+	}
+}
+
+func TestUnitControllerStartFailure(t *testing.T) {
+	ctrl, _ := newTestUnitController(t, "fail-app.service")
+
+	_, err := ctrl.startSystemdUnit()
+	if !errors.Is(err, ErrUnitFailed) {
+		t.Errorf("startSystemdUnit() = %v, want ErrUnitFailed", err)
+	}
+	if err := ctrl.waitUntilActive(time.Second); err == nil {
+		t.Error("waitUntilActive() succeeded for a failed unit")
+	}
+}
+
+func TestUnitControllerStartJobTimeout(t *testing.T) {
+	ctrl, _ := newTestUnitController(t, "hang-app.service")
+	ctrl.jobTimeout = 200 * time.Millisecond
+
+	begin := time.Now()
+	_, err := ctrl.startSystemdUnit()
+	if err == nil || !strings.Contains(err.Error(), "didn't finish") {
+		t.Errorf("startSystemdUnit() = %v, want a timeout", err)
+	}
+	if waited := time.Since(begin); waited > 2*time.Second {
+		t.Errorf("startSystemdUnit() took %v with a job timeout of %v", waited, ctrl.jobTimeout)
+	}
+}
+
+func TestUnitControllerMissingUnit(t *testing.T) {
+	ctrl, _ := newTestUnitController(t, "app.service", "missing-app.service")
+
+	err := ctrl.checkUnitsExist()
+	if err == nil || !strings.Contains(err.Error(), "missing-app.service does not exist") {
+		t.Errorf("checkUnitsExist() = %v, want missing-app.service not to exist", err)
+	}
+}
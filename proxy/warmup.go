@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+// warmupInterval is the pause between warmup probes.
+const warmupInterval = 200 * time.Millisecond
+
+// warmUp probes every backend until it passed the given number of probes in a
+// row, so clients don't hit a backend that accepts connections before it
+// is ready to serve them. It gives up after the backend timeout.
+func (p *Proxy) warmUp(probes int) error {
+	deadline := time.Now().Add(p.config.BackendTimeout)
+	for _, backend := range p.current.Load().backends {
+		if isTemplate(backend) {
+			continue
+		}
+
+		passed := 0
+		for passed < probes {
+			err := p.probeBackend(backend)
+			if err == nil {
+				passed++
+			} else {
+				p.log.Debug("warmup probe failed", "backend", backend, "err", err)
+				passed = 0
+			}
+			if passed < probes {
+				if time.Now().After(deadline) {
+					return fmt.Errorf("%s not warmed up after %v: %w", backend, p.config.BackendTimeout, err)
+				}
+				time.Sleep(warmupInterval)
+			}
+		}
+		p.log.Info("backend warmed up", "backend", backend, "probes", probes)
+	}
+	return nil
+}
+
+// probeBackend connects to backend and, if configured, sends the warmup
+// payload and checks the response.
+func (p *Proxy) probeBackend(backend string) error {
+	conn, err := p.dialOneBackend(backend)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if p.warmupSend == nil {
+		return nil
+	}
+
+	conn.SetDeadline(time.Now().Add(p.config.DialTimeout))
+	if _, err := conn.Write(p.warmupSend); err != nil {
+		return err
+	}
+	response := make([]byte, 4096)
+	n, err := io.ReadAtLeast(conn, response, max(len(p.config.WarmupExpect), 1))
+	if err != nil && n == 0 {
+		return err
+	}
+	if !bytes.Contains(response[:n], []byte(p.config.WarmupExpect)) {
+		return fmt.Errorf("unexpected response %q", response[:n])
+	}
+	return nil
+}
@@ -1,168 +1,296 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
-	"log"
-	"net"
+	"log/slog"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
-	"github.com/godbus/dbus"
+	"github.com/andrioid/socket-activate/proxy"
 )
 
+// build metadata, set via -ldflags "-X main.version=..."
 var (
-	mode               = flag.String("m", "tcp", "mode, available: tcp")
-	targetUnit         = flag.String("u", "null.service", "corresponding unit")
-	destinationAddress = flag.String("a", "127.0.0.1:80", "destination address")
-	timeout            = flag.Duration("t", 0, "inactivity timeout after which to stop the unit again")
-	user               = flag.Bool("user", false, "run as user session")
-	backendTimeout     = flag.Duration("backend-timeout", 30*time.Second, "maximum time to wait for backend connection")
+	version = "dev"
+	commit  = "unknown"
+	date    = "unknown"
 )
 
-type unitController struct {
-	conn     *dbus.Conn
-	unitname string
-}
+var (
+	mode                = flag.String("m", "tcp", "mode, available: tcp, udp, http (routes by Host header, see -http-map)")
+	targetUnit          = flag.String("u", "null.service", "corresponding unit, comma-separated to start several together, which are stopped in reverse order")
+	instance            = flag.String("instance", "", "instance to start if the unit is a template (e.g. myapp@.service)")
+	startMode           = flag.String("start-mode", "replace", "job mode for starting the unit, available: replace, fail, isolate, ignore-dependencies, ignore-requirements, replace-irreversibly, flush")
+	stopMode            = flag.String("stop-mode", "replace", "job mode for stopping the unit, available: replace, fail, ignore-dependencies, ignore-requirements, replace-irreversibly, flush, triggering")
+	destinationAddress  = flag.String("a", "127.0.0.1:80", "destination address, either host:port ([::1]:port for IPv6) or a Unix socket as unix:/path or /path, comma-separated to balance connections round-robin, %P expands to the port of the activated socket, %H to the host routed by")
+	timeout             = flag.Duration("t", 0, "inactivity timeout after which to stop the unit again")
+	maxLifetime         = flag.Duration("max-lifetime", 0, "stop the unit after it has been running this long, regardless of activity, 0 to disable")
+	minLifetime         = flag.Duration("min-lifetime", 0, "don't stop the unit for inactivity before it has been running this long, against start/stop flapping on sockets with little traffic")
+	preStopSignal       = flag.String("pre-stop-signal", "", "signal to send the unit before stopping it, e.g. SIGUSR1 to make it persist its state, empty to just stop it")
+	preStopGrace        = flag.Duration("pre-stop-grace", 5*time.Second, "time to give the unit after -pre-stop-signal before stopping it")
+	dbusAddress         = flag.String("dbus-address", "", "address of the D-Bus to manage the unit on (e.g. unix:path=/run/dbus/system_bus_socket), overrides -user")
+	noStop              = flag.Bool("no-stop", false, "never stop the unit, e.g. because other activators share it")
+	stopOnlyIfStarted   = flag.Bool("stop-only-if-started", false, "on idle only stop the units the proxy started itself, not those that were already active")
+	minThroughput       = flag.Int64("min-bytes-per-interval", 0, "also stop the unit once fewer bytes than this were proxied within the inactivity timeout -t, even with connections open, 0 to disable")
+	lockDir             = flag.String("lock-dir", "", "directory to register in as activator of the unit, so only the last activator going idle stops it (e.g. /run/socket-activate)")
+	listen              = flag.String("listen", "", "listen on this address (host:port or unix:/path) instead of using the sockets passed by systemd, e.g. for testing")
+	dryRun              = flag.Bool("dry-run", false, "log the D-Bus calls that would start and stop the unit instead of making them, but proxy as usual")
+	noUnit              = flag.Bool("no-unit", false, "don't manage the unit on D-Bus at all, just proxy")
+	lazyStart           = flag.Bool("lazy-start", false, "start the unit only once the first client connects instead of right away")
+	user                = flag.Bool("user", false, "run as user session")
+	backendTimeout      = flag.Duration("backend-timeout", 30*time.Second, "maximum time to wait for backend connection")
+	timeoutAction       = flag.String("backend-timeout-action", "drop", "what to do once a connection waited -backend-timeout, available: drop (the connection), exit-error, stop-unit (and exit with an error), keep-retrying")
+	dialTimeout         = flag.Duration("dial-timeout", 5*time.Second, "timeout of a single backend connection attempt")
+	resolveTTL          = flag.Duration("resolve-ttl", 0, "how long to cache the addresses a backend hostname resolves to, all of which are tried in turn, 0 to resolve on every connection")
+	heDelay             = flag.Duration("he-delay", 0, "race the IPv6 and IPv4 addresses of a backend hostname (Happy Eyeballs), starting the next attempt after this long, e.g. 250ms, 0 to try them in turn")
+	retryMax            = flag.Int("retry-max", 0, "maximum number of backend connection retries, 0 for no limit besides -backend-timeout")
+	retryBaseDelay      = flag.Duration("retry-base-delay", time.Second, "base delay of the exponential backoff between backend connection retries")
+	retryMaxDelay       = flag.Duration("retry-max-delay", 256*time.Second, "maximum delay between backend connection retries")
+	drainTimeout        = flag.Duration("drain-timeout", 10*time.Second, "maximum time to wait for open connections to close before stopping the unit")
+	restartOnFailure    = flag.Bool("restart-on-failure", false, "start the unit again when connections repeatedly fail to reach the backend, e.g. after it crashed")
+	restartCooldown     = flag.Duration("restart-cooldown", time.Minute, "minimum time between restarts by -restart-on-failure")
+	warmup              = flag.Int("warmup", 0, "number of probes every backend must pass in a row after the unit started, before clients are forwarded, 0 to disable")
+	warmupSend          = flag.String("warmup-send", "", "payload to send as -warmup probe, escapes like \\r\\n are interpreted, empty to only connect and close")
+	warmupExpect        = flag.String("warmup-expect", "", "text the response to -warmup-send must contain, any response if empty")
+	pauseAccept         = flag.Bool("accept-pause-until-ready", false, "don't accept connections until the backend can be connected to after starting the unit, letting them wait in the listen queue")
+	connIdleTimeout     = flag.Duration("conn-idle-timeout", 0, "close proxied connections after this long without any data transferred, 0 to disable")
+	clientIdleTimeout   = flag.Duration("client-idle-timeout", 0, "close proxied connections once the client sent nothing for this long, 0 to disable")
+	backendIdleTimeout  = flag.Duration("backend-idle-timeout", 0, "close proxied connections once the backend sent nothing for this long, e.g. because it hung, 0 to disable")
+	udpClientTimeout    = flag.Duration("udp-client-timeout", proxy.DefaultUDPClientTimeout, "in udp mode, close the backend socket of a client after this long without datagrams in either direction")
+	healthInterval      = flag.Duration("health-interval", 0, "interval between backend health checks, unhealthy backends get no new connections, 0 to disable")
+	maxConns            = flag.Int("max-conns", 0, "maximum number of concurrently proxied connections, 0 for no limit")
+	maxConnsAction      = flag.String("max-conns-action", "wait", "what to do with new connections once -max-conns is reached, available: wait, reject")
+	queueTimeout        = flag.Duration("queue-timeout", 0, "park connections arriving before the backend was reached and forward them once it is, dropping those waiting longer than this, 0 to dial for each connection in turn")
+	queueSize           = flag.Int("queue-size", 128, "maximum number of connections parked with -queue-timeout, others are rejected")
+	acceptRate          = flag.Float64("accept-rate", 0, "maximum number of new connections accepted per second, 0 for no limit")
+	acceptBurst         = flag.Int("accept-burst", 1, "number of connections accepted at once before -accept-rate applies")
+	acceptRateAction    = flag.String("accept-rate-action", "wait", "what to do with new connections above -accept-rate, available: wait, reject")
+	allowCIDR           = flag.String("allow-cidr", "", "comma-separated CIDRs clients may connect from, empty to allow all")
+	denyCIDR            = flag.String("deny-cidr", "", "comma-separated CIDRs clients may not connect from, taking precedence over -allow-cidr")
+	keepAlive           = flag.Duration("keepalive", 30*time.Second, "TCP keepalive period of proxied connections, 0 to disable keepalive")
+	noDelay             = flag.Bool("nodelay", true, "set TCP_NODELAY on proxied connections")
+	proxyProtocol       = flag.String("proxy-protocol", "", "send a PROXY protocol header with the client address to the backend, available: v1, v2")
+	acceptProxyProtocol = flag.Bool("accept-proxy-protocol", false, "expect a PROXY protocol v1 or v2 header on incoming connections and use the client address from it")
+	tlsCert             = flag.String("tls-cert", "", "certificate file to terminate TLS on the activated socket with, reloaded when it changes, requires -tls-key")
+	tlsKey              = flag.String("tls-key", "", "key file of -tls-cert")
+	backendTLS          = flag.Bool("backend-tls", false, "connect to the backend via TLS")
+	backendTLSServer    = flag.String("backend-tls-servername", "", "server name to send and verify with -backend-tls, defaults to the backend host")
+	backendTLSInsecure  = flag.Bool("backend-tls-insecure", false, "don't verify the backend certificate with -backend-tls")
+	backendLocalAddr    = flag.String("backend-local-addr", "", "local IP address to connect to backends from, e.g. on hosts with several addresses")
+	backendInterface    = flag.String("backend-interface", "", "network interface to bind backend connections to (SO_BINDTODEVICE), e.g. eth1")
+	backendSOCKS5       = flag.String("backend-socks5", "", "connect to TCP backends through this SOCKS5 proxy, as [user:password@]host:port")
+	backendPoolSize     = flag.Int("backend-pool-size", 0, "number of backend connections to open ahead once the unit is up, handed to new clients and refilled in the background, for backends with expensive connection setup")
+	sniMap              = flag.String("sni-map", "", "route TLS connections by server name without terminating them, as comma-separated name=backend pairs, others go to -a")
+	httpMap             = flag.String("http-map", "", "route HTTP requests by host in http mode, as comma-separated host=backend pairs")
+	httpDefault         = flag.String("http-default", "", "backend for hosts missing in -http-map, empty to answer them with 502 Bad Gateway")
+	fdHandoffSocket     = flag.String("fd-handoff-socket", "", "pass accepted connections to the backend over this Unix socket (SCM_RIGHTS) instead of proxying them, the backend must support it")
+	execCommand         = flag.String("exec", "", "run this command for each connection, wired to its stdin and stdout inetd style, instead of connecting to the destination address")
+	routeExpr           = flag.String("route-expr", "", "expression choosing the backend of each connection from clientIP, clientPort, serverName, localPort, hour and weekday, e.g. 'inCIDR(clientIP, \"10.0.0.0/8\") ? \"127.0.0.1:8081\" : \"\"', an empty result uses the usual routing")
+	transparent         = flag.Bool("transparent", false, "forward connections to the address they were sent to before an iptables/nftables TPROXY or REDIRECT rule diverted them to the socket, instead of to the destination address")
+	bufferSize          = flag.Int("buffer-size", proxy.DefaultBufferSize, "size in bytes of the buffer used for each direction of a proxied connection")
+	fdName              = flag.String("fdname", "", "only use the activated socket(s) with this FileDescriptorName (from LISTEN_FDNAMES)")
+	metricsAddr         = flag.String("metrics-addr", "", "address to serve Prometheus metrics on (e.g. 127.0.0.1:9101), disabled if empty")
+	controlSocket       = flag.String("control-socket", "", "Unix socket to answer the commands status (JSON with connections, activity, units and backend health) and stop on, one per line")
+	auditLog            = flag.String("audit-log", "", "file to append a JSON line to for every start and stop of the unit, with what triggered it, e.g. for billing")
+	check               = flag.Bool("check", false, "print the socket activation environment and resolved configuration, then exit non-zero if activation looks wrong")
+	configFile          = flag.String("config", "", "TOML file to read options from, keyed by flag name, flags given on the command line take precedence")
+	showVersion         = flag.Bool("version", false, "print version and build information and exit")
+	logLevel            = flag.String("log-level", "info", "log level, available: debug, info, warn, error")
+	journal             = flag.Bool("journal", false, "log to the systemd journal with priorities instead of to stderr, which is the fallback if the journal isn't available")
+)
 
-func newUnitController(name string) unitController {
-	// Connect to SystemBus if user is false, otherwise connect to SessionBus
-	if *user {
-		conn, err := dbus.SessionBus()
-		if err != nil {
-			log.Fatal(err)
-		}
-		return unitController{conn, name}
-	}
-	// Connect to SystemBus
-	conn, err := dbus.SystemBus()
-	if err != nil {
-		log.Fatal(err)
-	}
-	return unitController{conn, name}
+func init() {
+	// the name users look for when they only want the forwarder without a bus
+	flag.BoolVar(noUnit, "no-dbus", false, "same as -no-unit: never connect to D-Bus, on idle just exit")
 }
 
-func (unitCtrl unitController) startSystemdUnit() {
-	var responseObjPath dbus.ObjectPath
-	obj := unitCtrl.conn.Object("org.freedesktop.systemd1", dbus.ObjectPath("/org/freedesktop/systemd1"))
-	err := obj.Call("org.freedesktop.systemd1.Manager.StartUnit", 0, unitCtrl.unitname, "replace").Store(&responseObjPath)
-	if err != nil {
-		log.Fatal(err)
-	}
+// exit codes, besides 2 for invalid flags
+const (
+	exitFailure            = 1 // invalid configuration and other errors
+	exitUnitFailed         = 3 // the unit failed to start
+	exitBackendUnreachable = 4 // the backend never became reachable within -backend-timeout
+)
 
+// fatal logs msg as error and exits with exitFailure.
+func fatal(msg string, args ...any) {
+	fatalCode(exitFailure, msg, args...)
 }
 
-func (unitCtrl unitController) stopSystemdUnit() {
-	var responseObjPath dbus.ObjectPath
-	obj := unitCtrl.conn.Object("org.freedesktop.systemd1", dbus.ObjectPath("/org/freedesktop/systemd1"))
-	err := obj.Call("org.freedesktop.systemd1.Manager.StopUnit", 0, unitCtrl.unitname, "replace").Store(&responseObjPath)
-	if err != nil {
-		log.Fatal(err)
-	}
-
+// fatalCode logs msg as error and exits with code.
+func fatalCode(code int, msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(code)
 }
 
-func (unitCtrl unitController) terminateWithoutActivity(activity <-chan bool) {
-	for {
-		select {
-		case <-activity:
-		case <-time.After(*timeout):
-			unitCtrl.stopSystemdUnit()
-			os.Exit(0)
-		}
+// proxyConfig returns the proxy configuration given by the flags.
+func proxyConfig() proxy.Config {
+	return proxy.Config{
+		Mode:                 *mode,
+		Unit:                 *targetUnit,
+		Instance:             *instance,
+		StartMode:            *startMode,
+		StopMode:             *stopMode,
+		PreStopSignal:        *preStopSignal,
+		PreStopGrace:         *preStopGrace,
+		Listen:               *listen,
+		NoUnit:               *noUnit,
+		DryRun:               *dryRun,
+		LazyStart:            *lazyStart,
+		DBusAddress:          *dbusAddress,
+		User:                 *user,
+		Destination:          *destinationAddress,
+		NoStop:               *noStop,
+		StopOnlyIfStarted:    *stopOnlyIfStarted,
+		MinBytesPerInterval:  *minThroughput,
+		LockDir:              *lockDir,
+		MaxLifetime:          *maxLifetime,
+		MinLifetime:          *minLifetime,
+		Timeout:              *timeout,
+		BackendTimeout:       *backendTimeout,
+		BackendTimeoutAction: *timeoutAction,
+		DialTimeout:          *dialTimeout,
+		ResolveTTL:           *resolveTTL,
+		HEDelay:              *heDelay,
+		RetryMax:             *retryMax,
+		RetryBaseDelay:       *retryBaseDelay,
+		RetryMaxDelay:        *retryMaxDelay,
+		RestartOnFailure:     *restartOnFailure,
+		RestartCooldown:      *restartCooldown,
+		DrainTimeout:         *drainTimeout,
+		Warmup:               *warmup,
+		WarmupSend:           *warmupSend,
+		WarmupExpect:         *warmupExpect,
+		PauseAccept:          *pauseAccept,
+		ConnIdleTimeout:      *connIdleTimeout,
+		ClientIdleTimeout:    *clientIdleTimeout,
+		BackendIdleTimeout:   *backendIdleTimeout,
+		UDPClientTimeout:     *udpClientTimeout,
+		HealthInterval:       *healthInterval,
+		MaxConns:             *maxConns,
+		MaxConnsAction:       *maxConnsAction,
+		QueueTimeout:         *queueTimeout,
+		QueueSize:            *queueSize,
+		AcceptRate:           *acceptRate,
+		AcceptBurst:          *acceptBurst,
+		AcceptRateAction:     *acceptRateAction,
+		AllowCIDR:            *allowCIDR,
+		DenyCIDR:             *denyCIDR,
+		KeepAlive:            *keepAlive,
+		NoDelay:              *noDelay,
+		ProxyProtocol:        *proxyProtocol,
+		AcceptProxyProtocol:  *acceptProxyProtocol,
+		TLSCert:              *tlsCert,
+		TLSKey:               *tlsKey,
+		BackendTLS:           *backendTLS,
+		BackendTLSServerName: *backendTLSServer,
+		BackendTLSInsecure:   *backendTLSInsecure,
+		BackendLocalAddr:     *backendLocalAddr,
+		BackendInterface:     *backendInterface,
+		BackendSOCKS5:        *backendSOCKS5,
+		BackendPoolSize:      *backendPoolSize,
+		SNIMap:               *sniMap,
+		HTTPMap:              *httpMap,
+		HTTPDefault:          *httpDefault,
+		FdHandoffSocket:      *fdHandoffSocket,
+		Exec:                 *execCommand,
+		Transparent:          *transparent,
+		RouteExpr:            *routeExpr,
+		BufferSize:           *bufferSize,
+		FdName:               *fdName,
+		MetricsAddr:          *metricsAddr,
+		AuditLog:             *auditLog,
+		ControlSocket:        *controlSocket,
 	}
 }
 
-func proxyNetworkConnections(from net.Conn, to net.Conn, activityMonitor chan<- bool) {
-	buffer := make([]byte, 1024)
+func main() {
 
-	for {
-		i, err := from.Read(buffer)
-		if err != nil {
-			return // EOF (if anything else, we scrap the connection anyways)
-		}
-		activityMonitor <- true
-		to.Write(buffer[:i])
-	}
-}
+	flag.Parse()
 
-func startTCPProxy(activityMonitor chan<- bool) {
-	l, err := net.FileListener(os.NewFile(3, "systemd-socket"))
-	if err != nil {
-		log.Fatal(err)
+	if *showVersion {
+		fmt.Printf("socket-activate %s (commit %s, built %s)\n", version, commit, date)
+		return
 	}
-	defer l.Close()
 
-	var hadSuccessfulConnection bool
-	startTime := time.Now()
+	// the command line takes precedence over the environment, which takes precedence over the config file
+	if err := setFlagsFromEnv(); err != nil {
+		fatal("invalid environment variable", "err", err)
+	}
+	given := setFlags()
+	if *configFile != "" {
+		if err := setFlagsFromFile(*configFile, given); err != nil {
+			fatal("reading config file failed", "err", err)
+		}
+	}
 
-	for {
-		activityMonitor <- true
-		connOutwards, err := l.Accept()
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		fatal("invalid log level", "level", *logLevel, "err", err)
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	if *journal {
+		handler, err := newJournalHandler(level)
 		if err != nil {
-			fmt.Println(err)
-			return
+			slog.Warn("connecting to the journal failed, logging to stderr", "err", err)
+		} else {
+			slog.SetDefault(slog.New(handler))
 		}
+	}
 
-		var connBackend net.Conn
-		attempt := 0
-		maxRetries := 10
-
-		for {
-			connBackend, err = net.Dial("tcp", *destinationAddress)
-			if err == nil {
-				break // Successfully connected
-			}
-
-			// If we had a successful connection before and now can't connect, exit
-			if hadSuccessfulConnection {
-				fmt.Println("Backend connection failed after previous success, exiting")
-				os.Exit(0)
-			}
-
-			// Check if we've exceeded the backend timeout
-			if time.Since(startTime) > *backendTimeout {
-				fmt.Printf("Backend connection attempts exceeded timeout of %v, exiting\n", *backendTimeout)
-				os.Exit(0)
-			}
+	if !*check && *listen == "" && os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		fatal("socket-activate is only meant to be run from a systemd unit, aborting.")
+	}
 
-			attempt++
-			if attempt >= maxRetries {
-				attempt = maxRetries - 1 // Cap the delay at max retry level
-			}
+	p, err := proxy.New(proxyConfig())
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
 
-			// Calculate delay using exponential backoff
-			delay := time.Duration(500*(1<<attempt)) * time.Millisecond
-			fmt.Printf("Connection attempt failed, retrying in %v: %v\n", delay, err)
-			time.Sleep(delay)
+	if *check {
+		if !p.Check(os.Stdout) {
+			os.Exit(1)
 		}
-
-		// Mark that we've had at least one successful connection
-		hadSuccessfulConnection = true
-
-		go proxyNetworkConnections(connOutwards, connBackend, activityMonitor)
-		go proxyNetworkConnections(connBackend, connOutwards, activityMonitor)
+		return
 	}
-}
-
-func main() {
 
-	flag.Parse()
-	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
-		log.Fatal("socket-activate is only meant to be run from a systemd unit, aborting.")
-	}
+	// stopping the proxy (e.g. via systemctl stop) takes the unit down with it
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-signals
+		p.Stop()
+	}()
 
-	unitCtrl := newUnitController(*targetUnit)
+	// a reload reads the config file again, only some settings change without a restart though
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	go func() {
+		for range reloads {
+			if *configFile != "" {
+				if err := reloadFlagsFromFile(*configFile, given); err != nil {
+					slog.Error("reading config file failed, keeping the current configuration", "err", err)
+					continue
+				}
+			}
+			if err := p.Reload(proxyConfig()); err != nil {
+				slog.Error("reloading configuration failed, keeping the current one", "err", err)
+			}
+		}
+	}()
 
-	activityMonitor := make(chan bool)
-	if *timeout != 0 {
-		go unitCtrl.terminateWithoutActivity(activityMonitor)
+	if err := p.Start(); err != nil {
+		code := exitFailure
+		switch {
+		case errors.Is(err, proxy.ErrUnitFailed):
+			code = exitUnitFailed
+		case errors.Is(err, proxy.ErrBackendUnreachable):
+			code = exitBackendUnreachable
+		}
+		fatalCode(code, "proxy failed", "err", err)
 	}
-
-	// first, connect to systemd for starting the unit
-	unitCtrl.startSystemdUnit()
-
-	// then take over the socket from systemd
-	startTCPProxy(activityMonitor)
 }